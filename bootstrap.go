@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/task"
+
+	"github.com/miekg/dns"
+)
+
+// BootstrapOptions resolves the hostname of the upstream itself through Transport instead of the
+// dialer. Addresses pins the upstream to static addresses, in which case nothing is resolved.
+type BootstrapOptions struct {
+	Transport Transport
+	Strategy  DomainStrategy
+	Addresses []netip.Addr
+}
+
+type bootstrapDialer struct {
+	dialer    N.Dialer
+	transport Transport
+	strategy  DomainStrategy
+	addresses []netip.Addr
+	access    sync.Mutex
+	cache     map[string]bootstrapCache
+}
+
+type bootstrapCache struct {
+	addresses []netip.Addr
+	expireAt  time.Time
+}
+
+func newBootstrapDialer(dialer N.Dialer, options BootstrapOptions) *bootstrapDialer {
+	return &bootstrapDialer{
+		dialer:    dialer,
+		transport: options.Transport,
+		strategy:  options.Strategy,
+		addresses: options.Addresses,
+		cache:     make(map[string]bootstrapCache),
+	}
+}
+
+func (d *bootstrapDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if destination.IsIP() {
+		return d.dialer.DialContext(ctx, network, destination)
+	}
+	addresses, err := d.lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	return N.DialParallel(ctx, serialDialer{d.dialer}, network, destination, addresses, d.strategy == DomainStrategyPreferIPv6, 0)
+}
+
+func (d *bootstrapDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	if destination.IsIP() {
+		return d.dialer.ListenPacket(ctx, destination)
+	}
+	addresses, err := d.lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := N.ListenSerial(ctx, d.dialer, destination, addresses)
+	return conn, err
+}
+
+func (d *bootstrapDialer) Upstream() any {
+	return d.dialer
+}
+
+func (d *bootstrapDialer) reset() {
+	d.access.Lock()
+	defer d.access.Unlock()
+	d.cache = make(map[string]bootstrapCache)
+}
+
+func (d *bootstrapDialer) lookup(ctx context.Context, domain string) ([]netip.Addr, error) {
+	if len(d.addresses) > 0 {
+		return d.addresses, nil
+	}
+	d.access.Lock()
+	cached, loaded := d.cache[domain]
+	d.access.Unlock()
+	if loaded && time.Now().Before(cached.expireAt) {
+		return cached.addresses, nil
+	}
+	if transportName, transportLoaded := transportNameFromContext(ctx); transportLoaded && transportName == d.transport.Name() {
+		return nil, E.New("DNS query loopback in transport[", transportName, "]")
+	}
+	ctx, cancel := context.WithTimeout(contextWithTransportName(ctx, d.transport.Name()), DefaultTimeout)
+	defer cancel()
+	addresses, timeToLive, err := d.resolve(ctx, domain)
+	if err != nil {
+		return nil, E.Cause(err, "bootstrap ", domain)
+	}
+	if len(addresses) == 0 {
+		return nil, E.New("bootstrap ", domain, ": no addresses")
+	}
+	if timeToLive > 0 {
+		d.access.Lock()
+		d.cache[domain] = bootstrapCache{addresses, time.Now().Add(time.Duration(timeToLive) * time.Second)}
+		d.access.Unlock()
+	}
+	return addresses, nil
+}
+
+func (d *bootstrapDialer) resolve(ctx context.Context, domain string) ([]netip.Addr, uint32, error) {
+	if !d.transport.Raw() {
+		addresses, err := d.transport.Lookup(ctx, domain, d.strategy)
+		return addresses, DefaultTTL, err
+	}
+	var (
+		response4  []netip.Addr
+		response6  []netip.Addr
+		timeToLive uint32
+		access     sync.Mutex
+		group      task.Group
+	)
+	exchange := func(qType uint16, addresses *[]netip.Addr) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			response, err := d.transport.Exchange(ctx, new(dns.Msg).SetQuestion(dns.Fqdn(domain), qType))
+			if err != nil {
+				return err
+			}
+			if response.Rcode != dns.RcodeSuccess {
+				return RCodeError(response.Rcode)
+			}
+			result, err := MessageToAddresses(response)
+			if err != nil {
+				return err
+			}
+			access.Lock()
+			defer access.Unlock()
+			*addresses = result
+			for _, record := range response.Answer {
+				if timeToLive == 0 || record.Header().Ttl < timeToLive {
+					timeToLive = record.Header().Ttl
+				}
+			}
+			return nil
+		}
+	}
+	if d.strategy != DomainStrategyUseIPv6 {
+		group.Append("exchange4", exchange(dns.TypeA, &response4))
+	}
+	if d.strategy != DomainStrategyUseIPv4 {
+		group.Append("exchange6", exchange(dns.TypeAAAA, &response6))
+	}
+	err := group.Run(ctx)
+	if len(response4) == 0 && len(response6) == 0 {
+		return nil, 0, err
+	}
+	return sortAddresses(response4, response6, d.strategy), timeToLive, nil
+}
+
+// serialDialer hides N.ParallelDialer, as N.DefaultDialer implements it by dialing back through N.DialSerial.
+type serialDialer struct {
+	N.Dialer
+}
+
+type bootstrapTransportWrapper struct {
+	Transport
+	dialer *bootstrapDialer
+}
+
+func (t *bootstrapTransportWrapper) Reset() {
+	t.dialer.reset()
+	t.Transport.Reset()
+}
@@ -0,0 +1,60 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrap(t *testing.T) {
+	server := newUDPTestServer(t, func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg {
+		return newTestAnswer(message)
+	})
+	port := strconv.Itoa(server.LocalAddr().(*net.UDPAddr).Port)
+	bootstrapTransport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Name:    "bootstrap",
+		Address: "rcode://address",
+		Block:   dns.BlockOptions{Addresses: []netip.Addr{netip.MustParseAddr("127.0.0.1")}},
+	})
+	require.NoError(t, err)
+	bootstrap := newTestTransport(bootstrapTransport.Exchange)
+	newTransport := func(options dns.BootstrapOptions) dns.Transport {
+		transport, createErr := dns.CreateTransport(dns.TransportOptions{
+			Context:   context.Background(),
+			Logger:    logger.NOP(),
+			Address:   "udp://dns.example:" + port,
+			Dialer:    N.SystemDialer,
+			Bootstrap: options,
+		})
+		require.NoError(t, createErr)
+		t.Cleanup(func() {
+			transport.Close()
+		})
+		return transport
+	}
+	exchange := func(transport dns.Transport) {
+		_, exchangeErr := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+		require.NoError(t, exchangeErr)
+	}
+
+	transport := newTransport(dns.BootstrapOptions{Transport: bootstrap, Strategy: dns.DomainStrategyUseIPv4})
+	exchange(transport)
+	require.Equal(t, int32(1), bootstrap.queries.Load())
+	transport.Reset()
+	exchange(transport)
+	require.Equal(t, int32(2), bootstrap.queries.Load())
+
+	exchange(newTransport(dns.BootstrapOptions{Addresses: []netip.Addr{netip.MustParseAddr("127.0.0.1")}}))
+	require.Equal(t, int32(2), bootstrap.queries.Load())
+}
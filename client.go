@@ -36,6 +36,7 @@ type Client struct {
 	independentCache bool
 	rdrc             RDRCStore
 	initRDRCFunc     func() RDRCStore
+	validator        *dnssecValidator
 	logger           logger.ContextLogger
 	cache            *cache.LruCache[dns.Question, *dns.Msg]
 	transportCache   *cache.LruCache[transportCacheKey, *dns.Msg]
@@ -58,6 +59,7 @@ type ClientOptions struct {
 	DisableExpire    bool
 	IndependentCache bool
 	RDRC             func() RDRCStore
+	DNSSEC           DNSSECOptions
 	Logger           logger.ContextLogger
 }
 
@@ -73,6 +75,9 @@ func NewClient(options ClientOptions) *Client {
 	if client.timeout == 0 {
 		client.timeout = DefaultTimeout
 	}
+	if options.DNSSEC.Enabled {
+		client.validator = newDNSSECValidator(options.DNSSEC)
+	}
 	if !client.disableCache {
 		if !client.independentCache {
 			client.cache = cache.New[dns.Question, *dns.Msg]()
@@ -117,7 +122,8 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 		len(message.Ns) == 0 &&
 		len(message.Extra) == 0 &&
 		!clientSubnetLoaded
-	disableCache := !isSimpleRequest || c.disableCache || DisableCacheFromContext(ctx)
+	// answers to CD queries skipped validation, they must not be served to other queries
+	disableCache := !isSimpleRequest || message.CheckingDisabled || c.disableCache || DisableCacheFromContext(ctx)
 	if !disableCache {
 		response, ttl := c.loadResponse(question, transport)
 		if response != nil {
@@ -157,16 +163,31 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 		if rejected {
 			return nil, ErrResponseRejectedCached
 		}
+		ctx = contextWithRDRCRejected(ctx, func(transportName string) bool {
+			return c.rdrc.LoadRDRC(transportName, question.Name, question.Qtype)
+		})
 	}
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	response, err := transport.Exchange(ctx, message)
+	validate := c.validator != nil && !message.CheckingDisabled
+	request := message
+	if validate {
+		request = c.validator.request(message)
+	}
+	ctx, responseTransport := contextWithResponseTransport(ctx)
+	exchangeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	response, err := transport.Exchange(exchangeCtx, request)
 	cancel()
 	if err != nil {
 		return nil, err
 	}
+	var dnssecState DNSSECState
+	if validate {
+		validateCtx, validateCancel := context.WithTimeout(ctx, c.timeout)
+		response, dnssecState = c.validator.response(validateCtx, transport, message, response)
+		validateCancel()
+	}
 	if responseChecker != nil && !responseChecker(response) {
 		if c.rdrc != nil {
-			c.rdrc.SaveRDRCAsync(transport.Name(), question.Name, question.Qtype, c.logger)
+			c.rdrc.SaveRDRCAsync(responseTransportName(transport, *responseTransport), question.Name, question.Qtype, c.logger)
 		}
 		return response, ErrResponseRejected
 	}
@@ -192,16 +213,26 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 	var timeToLive int
 	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 		for _, record := range recordList {
+			// the OPT TTL carries the extended rcode and flags
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
 			if timeToLive == 0 || record.Header().Ttl > 0 && int(record.Header().Ttl) < timeToLive {
 				timeToLive = int(record.Header().Ttl)
 			}
 		}
 	}
+	if dnssecState == DNSSECBogus {
+		timeToLive = dnssecBogusTTL
+	}
 	if rewriteTTL, loaded := RewriteTTLFromContext(ctx); loaded {
 		timeToLive = int(rewriteTTL)
 	}
 	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
 			record.Header().Ttl = uint32(timeToLive)
 		}
 	}
@@ -300,7 +331,12 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 		if rejected {
 			return nil, ErrResponseRejectedCached
 		}
+		ctx = contextWithRDRCRejected(ctx, func(transportName string) bool {
+			return strategy != DomainStrategyUseIPv6 && c.rdrc.LoadRDRC(transportName, dnsName, dns.TypeA) ||
+				strategy != DomainStrategyUseIPv4 && c.rdrc.LoadRDRC(transportName, dnsName, dns.TypeAAAA)
+		})
 	}
+	ctx, responseTransport := contextWithResponseTransport(ctx)
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	var rCode int
 	response, err := transport.Lookup(ctx, domain, strategy)
@@ -310,15 +346,16 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 	}
 	if responseChecker != nil && !responseChecker(response) {
 		if c.rdrc != nil {
+			transportName := responseTransportName(transport, *responseTransport)
 			if common.Any(response, func(addr netip.Addr) bool {
 				return addr.Is4()
 			}) {
-				c.rdrc.SaveRDRCAsync(transport.Name(), dnsName, dns.TypeA, c.logger)
+				c.rdrc.SaveRDRCAsync(transportName, dnsName, dns.TypeA, c.logger)
 			}
 			if common.Any(response, func(addr netip.Addr) bool {
 				return addr.Is6()
 			}) {
-				c.rdrc.SaveRDRCAsync(transport.Name(), dnsName, dns.TypeAAAA, c.logger)
+				c.rdrc.SaveRDRCAsync(transportName, dnsName, dns.TypeAAAA, c.logger)
 			}
 		}
 		return response, ErrResponseRejected
@@ -657,6 +694,9 @@ func (c *Client) loadResponse(question dns.Question, transport Transport) (*dns.
 		var originTTL int
 		for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 			for _, record := range recordList {
+				if record.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
 				if originTTL == 0 || record.Header().Ttl > 0 && int(record.Header().Ttl) < originTTL {
 					originTTL = int(record.Header().Ttl)
 				}
@@ -671,12 +711,18 @@ func (c *Client) loadResponse(question dns.Question, transport Transport) (*dns.
 			duration := uint32(originTTL - nowTTL)
 			for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 				for _, record := range recordList {
+					if record.Header().Rrtype == dns.TypeOPT {
+						continue
+					}
 					record.Header().Ttl = record.Header().Ttl - duration
 				}
 			}
 		} else {
 			for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 				for _, record := range recordList {
+					if record.Header().Rrtype == dns.TypeOPT {
+						continue
+					}
 					record.Header().Ttl = uint32(nowTTL)
 				}
 			}
@@ -718,3 +764,10 @@ func wrapError(err error) error {
 	}
 	return err
 }
+
+func responseTransportName(transport Transport, responseTransport string) string {
+	if responseTransport != "" {
+		return responseTransport
+	}
+	return transport.Name()
+}
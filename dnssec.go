@@ -0,0 +1,776 @@
+package dns
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/cache"
+	F "github.com/sagernet/sing/common/format"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecBogusTTL      = 60
+	dnssecMaxZoneTTL    = 3600
+	dnssecZoneCacheSize = 1024
+	// RFC 9276 3.2: zones with costlier NSEC3 chains are treated as unsigned instead of hashed
+	dnssecMaxNSEC3Iterations = 150
+)
+
+// DefaultTrustAnchors are the DS records of the root KSK-2017 and KSK-2024.
+var DefaultTrustAnchors = []*dns.DS{
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	},
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	},
+}
+
+// DNSSECOptions enables validation in Client. Queries are sent with DO and CD set, DNSKEY and DS
+// records are fetched through the same transport, and bogus answers turn into SERVFAIL carrying
+// an extended DNS error. Queries with CD set are passed through without validation.
+type DNSSECOptions struct {
+	Enabled      bool
+	TrustAnchors []*dns.DS
+}
+
+type DNSSECState uint8
+
+const (
+	DNSSECInsecure DNSSECState = iota
+	DNSSECSecure
+	DNSSECBogus
+)
+
+func (s DNSSECState) String() string {
+	switch s {
+	case DNSSECInsecure:
+		return "insecure"
+	case DNSSECSecure:
+		return "secure"
+	case DNSSECBogus:
+		return "bogus"
+	default:
+		return "unknown"
+	}
+}
+
+// DNSSECStateFromResponse returns the validation state of a response returned by a validating Client.
+func DNSSECStateFromResponse(response *dns.Msg) DNSSECState {
+	if response.AuthenticatedData {
+		return DNSSECSecure
+	}
+	if response.Rcode == dns.RcodeServerFailure {
+		if optRecord := response.IsEdns0(); optRecord != nil {
+			for _, option := range optRecord.Option {
+				if extendedError, isExtendedError := option.(*dns.EDNS0_EDE); isExtendedError && isDNSSECErrorCode(extendedError.InfoCode) {
+					return DNSSECBogus
+				}
+			}
+		}
+	}
+	return DNSSECInsecure
+}
+
+func isDNSSECErrorCode(infoCode uint16) bool {
+	switch infoCode {
+	case dns.ExtendedErrorCodeUnsupportedDNSKEYAlgorithm, dns.ExtendedErrorCodeUnsupportedDSDigestType,
+		dns.ExtendedErrorCodeDNSSECIndeterminate, dns.ExtendedErrorCodeDNSBogus,
+		dns.ExtendedErrorCodeSignatureExpired, dns.ExtendedErrorCodeSignatureNotYetValid,
+		dns.ExtendedErrorCodeDNSKEYMissing, dns.ExtendedErrorCodeRRSIGsMissing,
+		dns.ExtendedErrorCodeNoZoneKeyBitSet, dns.ExtendedErrorCodeNSECMissing:
+		return true
+	default:
+		return false
+	}
+}
+
+type dnssecError struct {
+	infoCode uint16
+	message  string
+}
+
+func newDNSSECError(infoCode uint16, message ...any) *dnssecError {
+	return &dnssecError{infoCode, F.ToString(message...)}
+}
+
+func (e *dnssecError) Error() string {
+	return "dnssec: " + e.message
+}
+
+type dnssecValidator struct {
+	trustAnchors []*dns.DS
+	zones        *cache.LruCache[dnssecZoneKey, *dnssecZone]
+}
+
+type dnssecZoneKey struct {
+	transportName string
+	name          string
+}
+
+// dnssecZone is the zone a name belongs to, insecure zones have no keys.
+type dnssecZone struct {
+	name     string
+	secure   bool
+	keys     []*dns.DNSKEY
+	expireAt time.Time
+}
+
+func newDNSSECValidator(options DNSSECOptions) *dnssecValidator {
+	trustAnchors := options.TrustAnchors
+	if len(trustAnchors) == 0 {
+		trustAnchors = DefaultTrustAnchors
+	}
+	return &dnssecValidator{
+		trustAnchors: trustAnchors,
+		zones:        cache.New(cache.WithSize[dnssecZoneKey, *dnssecZone](dnssecZoneCacheSize)),
+	}
+}
+
+// request returns a copy of the query asking for DNSSEC records without upstream validation.
+func (v *dnssecValidator) request(message *dns.Msg) *dns.Msg {
+	message = message.Copy()
+	optRecord := message.IsEdns0()
+	if optRecord == nil {
+		message.SetEdns0(dns.DefaultMsgSize, true)
+	} else {
+		optRecord.SetDo()
+	}
+	message.CheckingDisabled = true
+	return message
+}
+
+// response validates the response to request and returns what the caller of Client gets: the AD bit
+// reflects the state, bogus answers become SERVFAIL, and DNSSEC records the caller did not ask for are removed.
+func (v *dnssecValidator) response(ctx context.Context, transport Transport, request *dns.Msg, response *dns.Msg) (*dns.Msg, DNSSECState) {
+	state, err := v.validate(ctx, transport, request.Question[0], response)
+	if err != nil {
+		infoCode := dns.ExtendedErrorCodeDNSSECIndeterminate
+		if dnssecErr, isDNSSECError := err.(*dnssecError); isDNSSECError {
+			infoCode = dnssecErr.infoCode
+		}
+		bogusResponse := new(dns.Msg)
+		bogusResponse.SetRcode(request, dns.RcodeServerFailure)
+		bogusResponse.RecursionAvailable = true
+		bogusResponse.SetEdns0(dns.DefaultMsgSize, false)
+		optRecord := bogusResponse.IsEdns0()
+		optRecord.Option = append(optRecord.Option, &dns.EDNS0_EDE{InfoCode: infoCode, ExtraText: err.Error()})
+		return bogusResponse, DNSSECBogus
+	}
+	response.AuthenticatedData = state == DNSSECSecure
+	response.CheckingDisabled = false
+	requestOPT := request.IsEdns0()
+	if requestOPT == nil || !requestOPT.Do() {
+		question := request.Question[0]
+		removeDNSSECRecords := func(records []dns.RR) []dns.RR {
+			return common.Filter(records, func(it dns.RR) bool {
+				switch it.Header().Rrtype {
+				case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+					return it.Header().Rrtype == question.Qtype
+				case dns.TypeOPT:
+					return requestOPT != nil
+				}
+				return true
+			})
+		}
+		response.Answer = removeDNSSECRecords(response.Answer)
+		response.Ns = removeDNSSECRecords(response.Ns)
+		response.Extra = removeDNSSECRecords(response.Extra)
+		if responseOPT := response.IsEdns0(); responseOPT != nil {
+			responseOPT.SetDo(false)
+		}
+	}
+	return response, state
+}
+
+func (v *dnssecValidator) validate(ctx context.Context, transport Transport, question dns.Question, response *dns.Msg) (DNSSECState, error) {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return DNSSECInsecure, nil
+	}
+	state := DNSSECSecure
+	rrsets, signatures := splitRRsets(response.Answer)
+	for _, rrset := range rrsets {
+		rrsetState, closestEncloser, err := v.verifyRRset(ctx, transport, rrset, signatures[rrsetKeyOf(rrset[0])])
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if closestEncloser != "" {
+			rrsetState, err = v.verifyWildcard(ctx, transport, dns.CanonicalName(rrset[0].Header().Name), closestEncloser, response.Ns)
+			if err != nil {
+				return DNSSECBogus, err
+			}
+		}
+		if rrsetState == DNSSECInsecure {
+			state = DNSSECInsecure
+		}
+	}
+	name := dns.CanonicalName(question.Name)
+	for chain := 0; chain < 8; chain++ {
+		var target string
+		for _, record := range response.Answer {
+			if cname, isCNAME := record.(*dns.CNAME); isCNAME && dns.CanonicalName(cname.Hdr.Name) == name {
+				target = dns.CanonicalName(cname.Target)
+			}
+		}
+		if target == "" || question.Qtype == dns.TypeCNAME {
+			break
+		}
+		name = target
+	}
+	answered := common.Any(response.Answer, func(it dns.RR) bool {
+		return dns.CanonicalName(it.Header().Name) == name && (it.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY)
+	})
+	if !answered {
+		denialState, err := v.verifyDenial(ctx, transport, name, question.Qtype, response.Rcode, response.Ns)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if denialState == DNSSECInsecure {
+			state = DNSSECInsecure
+		}
+	}
+	return state, nil
+}
+
+// verifyRRset checks the signatures of rrset, closestEncloser is set when it was expanded from a wildcard.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, transport Transport, rrset []dns.RR, signatures []*dns.RRSIG) (state DNSSECState, closestEncloser string, err error) {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+	if len(signatures) == 0 {
+		zone, err := v.zoneOf(ctx, transport, owner)
+		if err != nil {
+			return DNSSECBogus, "", err
+		}
+		if !zone.secure {
+			return DNSSECInsecure, "", nil
+		}
+		return DNSSECBogus, "", newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "missing RRSIG for ", owner, " ", dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+	var lastErr error
+	for _, signature := range signatures {
+		signerName := dns.CanonicalName(signature.SignerName)
+		if !dns.IsSubDomain(signerName, owner) {
+			lastErr = newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "signer ", signerName, " is not above ", owner)
+			continue
+		}
+		zone, err := v.zoneOf(ctx, transport, signerName)
+		if err != nil {
+			return DNSSECBogus, "", err
+		}
+		if !zone.secure {
+			return DNSSECInsecure, "", nil
+		}
+		if zone.name != signerName {
+			lastErr = newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "signer ", signerName, " is not a zone apex")
+			continue
+		}
+		lastErr = verifySignature(zone.keys, signature, rrset)
+		if lastErr == nil {
+			return DNSSECSecure, wildcardEncloser(owner, signature.Labels), nil
+		}
+	}
+	return DNSSECBogus, "", lastErr
+}
+
+// wildcardEncloser returns the closest encloser of the wildcard an RRset signed with labels
+// was expanded from, or empty if the owner is not a wildcard expansion.
+func wildcardEncloser(owner string, labels uint8) string {
+	ownerLabels := dns.SplitDomainName(owner)
+	if len(ownerLabels) <= int(labels) || len(ownerLabels) == int(labels)+1 && ownerLabels[0] == "*" {
+		return ""
+	}
+	return dns.Fqdn(strings.Join(ownerLabels[len(ownerLabels)-int(labels):], "."))
+}
+
+func verifySignature(keys []*dns.DNSKEY, signature *dns.RRSIG, rrset []dns.RR) error {
+	ownerLabels := dns.SplitDomainName(rrset[0].Header().Name)
+	if len(ownerLabels) > 0 && ownerLabels[0] == "*" {
+		ownerLabels = ownerLabels[1:]
+	}
+	if int(signature.Labels) > len(ownerLabels) {
+		return newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "bad label count in signature of ", rrset[0].Header().Name)
+	}
+	now := time.Now()
+	if !signature.ValidityPeriod(now) {
+		if int64(signature.Inception) > now.Unix() {
+			return newDNSSECError(dns.ExtendedErrorCodeSignatureNotYetValid, "signature of ", rrset[0].Header().Name, " is not yet valid")
+		}
+		return newDNSSECError(dns.ExtendedErrorCodeSignatureExpired, "signature of ", rrset[0].Header().Name, " expired")
+	}
+	var keyFound bool
+	for _, key := range keys {
+		if key.Algorithm != signature.Algorithm || key.KeyTag() != signature.KeyTag || key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		keyFound = true
+		if signature.Verify(key, rrset) == nil {
+			return nil
+		}
+	}
+	if !keyFound {
+		return newDNSSECError(dns.ExtendedErrorCodeDNSKEYMissing, "missing DNSKEY ", signature.KeyTag, " for ", rrset[0].Header().Name)
+	}
+	return newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "bad signature for ", rrset[0].Header().Name, " ", dns.TypeToString[rrset[0].Header().Rrtype])
+}
+
+// zoneOf walks the chain of trust from the root down to name.
+func (v *dnssecValidator) zoneOf(ctx context.Context, transport Transport, name string) (*dnssecZone, error) {
+	name = dns.CanonicalName(name)
+	if zone, loaded := v.loadZone(transport, name); loaded {
+		return zone, nil
+	}
+	zone, loaded := v.loadZone(transport, ".")
+	if !loaded {
+		var err error
+		zone, err = v.fetchKeys(ctx, transport, ".", v.trustAnchors, time.Now().Add(dnssecMaxZoneTTL*time.Second))
+		if err != nil {
+			return nil, err
+		}
+		v.storeZone(transport, ".", zone)
+	}
+	labels := dns.SplitDomainName(name)
+	for index := len(labels) - 1; index >= 0; index-- {
+		child := dns.Fqdn(strings.Join(labels[index:], "."))
+		if cachedZone, cached := v.loadZone(transport, child); cached {
+			zone = cachedZone
+			continue
+		}
+		if zone.secure {
+			childZone, err := v.delegate(ctx, transport, zone, child)
+			if err != nil {
+				return nil, err
+			}
+			zone = childZone
+		}
+		v.storeZone(transport, child, zone)
+	}
+	return zone, nil
+}
+
+func (v *dnssecValidator) loadZone(transport Transport, name string) (*dnssecZone, bool) {
+	zone, loaded := v.zones.Load(dnssecZoneKey{transport.Name(), name})
+	if !loaded || time.Now().After(zone.expireAt) {
+		return nil, false
+	}
+	return zone, true
+}
+
+func (v *dnssecValidator) storeZone(transport Transport, name string, zone *dnssecZone) {
+	v.zones.StoreWithExpire(dnssecZoneKey{transport.Name(), name}, zone, zone.expireAt)
+}
+
+// delegate returns the zone of child, which is parent unless child is a zone cut.
+func (v *dnssecValidator) delegate(ctx context.Context, transport Transport, parent *dnssecZone, child string) (*dnssecZone, error) {
+	response, err := v.exchange(ctx, transport, child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, signatures := splitRRsets(response.Answer)
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype != dns.TypeDS || dns.CanonicalName(rrset[0].Header().Name) != child {
+			continue
+		}
+		err = verifyZoneSignature(parent, rrset, signatures[rrsetKeyOf(rrset[0])])
+		if err != nil {
+			return nil, err
+		}
+		dsSet := make([]*dns.DS, 0, len(rrset))
+		for _, record := range rrset {
+			dsSet = append(dsSet, record.(*dns.DS))
+		}
+		return v.fetchKeys(ctx, transport, child, dsSet, parent.expireAt)
+	}
+	rrsets, signatures = splitRRsets(response.Ns)
+	var denial []dns.RR
+	for _, rrset := range rrsets {
+		if recordType := rrset[0].Header().Rrtype; recordType != dns.TypeNSEC && recordType != dns.TypeNSEC3 {
+			continue
+		}
+		err = verifyZoneSignature(parent, rrset, signatures[rrsetKeyOf(rrset[0])])
+		if err != nil {
+			return nil, err
+		}
+		denial = append(denial, rrset...)
+	}
+	insecureZone := &dnssecZone{name: child, expireAt: parent.expireAt}
+	if nsec3Unsupported(denial) {
+		return insecureZone, nil
+	}
+	for _, record := range denial {
+		var bitmap []uint16
+		switch denialRecord := record.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(denialRecord.Hdr.Name) != child {
+				if nsecCovers(denialRecord, child) {
+					return parent, nil
+				}
+				continue
+			}
+			bitmap = denialRecord.TypeBitMap
+		case *dns.NSEC3:
+			if !denialRecord.Match(child) {
+				continue
+			}
+			bitmap = denialRecord.TypeBitMap
+		default:
+			continue
+		}
+		if hasType(bitmap, dns.TypeDS) {
+			// RFC 4035 5.2: a signed delegation whose DS RRset went missing
+			return nil, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "missing DS for ", child, " listed in its denial")
+		}
+		if hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) {
+			return insecureZone, nil
+		}
+		return parent, nil
+	}
+	_, nextCloser, optOut := nsec3ClosestEncloser(child, denial)
+	if nextCloser != "" {
+		if optOut {
+			return insecureZone, nil
+		}
+		return parent, nil
+	}
+	return nil, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "missing DS denial for ", child)
+}
+
+// fetchKeys returns the secure zone of name, with DNSKEY records authenticated by dsSet.
+func (v *dnssecValidator) fetchKeys(ctx context.Context, transport Transport, name string, dsSet []*dns.DS, expireAt time.Time) (*dnssecZone, error) {
+	supportedSet := common.Filter(dsSet, func(it *dns.DS) bool {
+		_, algorithmSupported := dns.AlgorithmToHash[it.Algorithm]
+		return algorithmSupported && (it.DigestType == dns.SHA1 || it.DigestType == dns.SHA256 || it.DigestType == dns.SHA384)
+	})
+	for _, ds := range dsSet {
+		if timeToLive := ds.Hdr.Ttl; timeToLive > 0 && time.Now().Add(time.Duration(timeToLive)*time.Second).Before(expireAt) {
+			expireAt = time.Now().Add(time.Duration(timeToLive) * time.Second)
+		}
+	}
+	if len(supportedSet) == 0 {
+		// RFC 6840 5.2: zones signed only with unsupported algorithms are treated as unsigned
+		return &dnssecZone{name: name, expireAt: expireAt}, nil
+	}
+	response, err := v.exchange(ctx, transport, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		keys        []*dns.DNSKEY
+		keySet      []dns.RR
+		trustedKeys []*dns.DNSKEY
+		signatures  []*dns.RRSIG
+	)
+	for _, record := range response.Answer {
+		if dns.CanonicalName(record.Header().Name) != name {
+			continue
+		}
+		switch answer := record.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, answer)
+			keySet = append(keySet, answer)
+			if timeToLive := answer.Hdr.Ttl; timeToLive > 0 && time.Now().Add(time.Duration(timeToLive)*time.Second).Before(expireAt) {
+				expireAt = time.Now().Add(time.Duration(timeToLive) * time.Second)
+			}
+			for _, ds := range supportedSet {
+				keyDS := answer.ToDS(ds.DigestType)
+				if keyDS != nil && keyDS.KeyTag == ds.KeyTag && keyDS.Algorithm == ds.Algorithm && strings.EqualFold(keyDS.Digest, ds.Digest) {
+					trustedKeys = append(trustedKeys, answer)
+					break
+				}
+			}
+		case *dns.RRSIG:
+			if answer.TypeCovered == dns.TypeDNSKEY {
+				signatures = append(signatures, answer)
+			}
+		}
+	}
+	if len(trustedKeys) == 0 {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of ", name, " matches its DS records")
+	}
+	if len(signatures) == 0 {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "missing RRSIG for ", name, " DNSKEY")
+	}
+	for _, signature := range signatures {
+		err = verifySignature(trustedKeys, signature, keySet)
+		if err == nil {
+			return &dnssecZone{name: name, secure: true, keys: keys, expireAt: expireAt}, nil
+		}
+	}
+	return nil, err
+}
+
+func verifyZoneSignature(zone *dnssecZone, rrset []dns.RR, signatures []*dns.RRSIG) error {
+	if len(signatures) == 0 {
+		return newDNSSECError(dns.ExtendedErrorCodeRRSIGsMissing, "missing RRSIG for ", rrset[0].Header().Name, " ", dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+	var err error
+	for _, signature := range signatures {
+		if dns.CanonicalName(signature.SignerName) != zone.name {
+			err = newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "unexpected signer ", signature.SignerName, " for ", rrset[0].Header().Name)
+			continue
+		}
+		err = verifySignature(zone.keys, signature, rrset)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// authenticateDenial verifies the NSEC and NSEC3 records of authority, the state is
+// insecure and no records are returned when the zone of name is unsigned.
+func (v *dnssecValidator) authenticateDenial(ctx context.Context, transport Transport, name string, authority []dns.RR) ([]dns.RR, DNSSECState, error) {
+	rrsets, signatures := splitRRsets(authority)
+	var denial []dns.RR
+	for _, rrset := range rrsets {
+		recordType := rrset[0].Header().Rrtype
+		if recordType != dns.TypeNSEC && recordType != dns.TypeNSEC3 && recordType != dns.TypeSOA {
+			continue
+		}
+		state, closestEncloser, err := v.verifyRRset(ctx, transport, rrset, signatures[rrsetKeyOf(rrset[0])])
+		if err != nil {
+			return nil, DNSSECBogus, err
+		}
+		if state == DNSSECInsecure {
+			return nil, DNSSECInsecure, nil
+		}
+		if closestEncloser != "" {
+			return nil, DNSSECBogus, newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "wildcard expanded ", dns.TypeToString[recordType], " for ", rrset[0].Header().Name)
+		}
+		if recordType != dns.TypeSOA {
+			denial = append(denial, rrset...)
+		}
+	}
+	if len(denial) == 0 {
+		zone, err := v.zoneOf(ctx, transport, name)
+		if err != nil {
+			return nil, DNSSECBogus, err
+		}
+		if !zone.secure {
+			return nil, DNSSECInsecure, nil
+		}
+		return nil, DNSSECBogus, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "missing denial of existence for ", name)
+	}
+	if nsec3Unsupported(denial) {
+		return nil, DNSSECInsecure, nil
+	}
+	return denial, DNSSECSecure, nil
+}
+
+// verifyWildcard checks the proof that name, answered by a wildcard of closestEncloser, does not exist itself.
+func (v *dnssecValidator) verifyWildcard(ctx context.Context, transport Transport, name string, closestEncloser string, authority []dns.RR) (DNSSECState, error) {
+	denial, state, err := v.authenticateDenial(ctx, transport, name, authority)
+	if err != nil || state == DNSSECInsecure {
+		return state, err
+	}
+	labels := dns.SplitDomainName(name)
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(closestEncloser)-1:], "."))
+	for _, record := range denial {
+		switch denialRecord := record.(type) {
+		case *dns.NSEC:
+			if nsecCovers(denialRecord, name) {
+				return DNSSECSecure, nil
+			}
+		case *dns.NSEC3:
+			if denialRecord.Cover(nextCloser) {
+				return DNSSECSecure, nil
+			}
+		}
+	}
+	return DNSSECBogus, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "missing denial of existence for wildcard expanded ", name)
+}
+
+// verifyDenial checks the NSEC or NSEC3 proof that name has no records of qType, or does not exist.
+func (v *dnssecValidator) verifyDenial(ctx context.Context, transport Transport, name string, qType uint16, rcode int, authority []dns.RR) (DNSSECState, error) {
+	denial, state, err := v.authenticateDenial(ctx, transport, name, authority)
+	if err != nil || state == DNSSECInsecure {
+		return state, err
+	}
+	for _, record := range denial {
+		switch denialRecord := record.(type) {
+		case *dns.NSEC:
+			if rcode == dns.RcodeSuccess && dns.CanonicalName(denialRecord.Hdr.Name) == name {
+				if !hasType(denialRecord.TypeBitMap, qType) && !hasType(denialRecord.TypeBitMap, dns.TypeCNAME) {
+					return DNSSECSecure, nil
+				}
+			} else if nsecCovers(denialRecord, name) {
+				if rcode == dns.RcodeSuccess {
+					// an empty non-terminal or answered by a wildcard
+					return DNSSECSecure, nil
+				}
+				// the name does not exist, and neither does the wildcard that would have answered it
+				wildcard := "*." + nsecClosestEncloser(denialRecord, name)
+				if common.Any(denial, func(it dns.RR) bool {
+					nsec, isNSEC := it.(*dns.NSEC)
+					return isNSEC && nsecCovers(nsec, wildcard)
+				}) {
+					return DNSSECSecure, nil
+				}
+			}
+		case *dns.NSEC3:
+			if rcode == dns.RcodeSuccess && denialRecord.Match(name) {
+				if !hasType(denialRecord.TypeBitMap, qType) && !hasType(denialRecord.TypeBitMap, dns.TypeCNAME) {
+					return DNSSECSecure, nil
+				}
+			}
+		}
+	}
+	closestEncloser, nextCloser, optOut := nsec3ClosestEncloser(name, denial)
+	if nextCloser != "" {
+		if optOut {
+			return DNSSECInsecure, nil
+		}
+		if rcode == dns.RcodeNameError {
+			if common.Any(denial, func(it dns.RR) bool {
+				nsec3, isNSEC3 := it.(*dns.NSEC3)
+				return isNSEC3 && nsec3.Cover("*."+closestEncloser)
+			}) {
+				return DNSSECSecure, nil
+			}
+			return DNSSECBogus, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "missing wildcard denial for ", name)
+		}
+		// wildcard NODATA
+		for _, record := range denial {
+			if nsec3, isNSEC3 := record.(*dns.NSEC3); isNSEC3 && nsec3.Match("*."+closestEncloser) && !hasType(nsec3.TypeBitMap, qType) {
+				return DNSSECSecure, nil
+			}
+		}
+	}
+	return DNSSECBogus, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no valid denial of existence for ", name)
+}
+
+func (v *dnssecValidator) exchange(ctx context.Context, transport Transport, name string, qType uint16) (*dns.Msg, error) {
+	message := new(dns.Msg).SetQuestion(name, qType)
+	message.SetEdns0(dns.DefaultMsgSize, true)
+	message.CheckingDisabled = true
+	response, err := transport.Exchange(ctx, message)
+	if err != nil {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSSECIndeterminate, "fetch ", name, " ", dns.TypeToString[qType], ": ", err)
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeDNSSECIndeterminate, "fetch ", name, " ", dns.TypeToString[qType], ": ", dns.RcodeToString[response.Rcode])
+	}
+	return response, nil
+}
+
+type rrsetKey struct {
+	name   string
+	rrType uint16
+}
+
+func rrsetKeyOf(record dns.RR) rrsetKey {
+	return rrsetKey{dns.CanonicalName(record.Header().Name), record.Header().Rrtype}
+}
+
+// splitRRsets groups records into RRsets in order of appearance, with signatures by the type they cover.
+func splitRRsets(records []dns.RR) ([][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	indexes := make(map[rrsetKey]int)
+	signatures := make(map[rrsetKey][]*dns.RRSIG)
+	for _, record := range records {
+		if signature, isSignature := record.(*dns.RRSIG); isSignature {
+			key := rrsetKey{dns.CanonicalName(signature.Hdr.Name), signature.TypeCovered}
+			signatures[key] = append(signatures[key], signature)
+			continue
+		}
+		if record.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKeyOf(record)
+		if index, loaded := indexes[key]; loaded {
+			rrsets[index] = append(rrsets[index], record)
+		} else {
+			indexes[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{record})
+		}
+	}
+	return rrsets, signatures
+}
+
+func hasType(bitmap []uint16, rrType uint16) bool {
+	return common.Contains(bitmap, rrType)
+}
+
+// nsecCovers reports whether name sorts strictly between the owner and the next name of the NSEC record.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone wraps around to the apex
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// nsecClosestEncloser returns the closest encloser of a name covered by nsec,
+// the longest ancestor it shares with the owner or the next name.
+func nsecClosestEncloser(nsec *dns.NSEC, name string) string {
+	commonLabels := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if nextLabels := dns.CompareDomainName(name, nsec.NextDomain); nextLabels > commonLabels {
+		commonLabels = nextLabels
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-commonLabels:], "."))
+}
+
+// canonicalCompare orders names as RFC 4034 6.1 does, comparing labels from the right.
+func canonicalCompare(a string, b string) int {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if compared := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); compared != 0 {
+			return compared
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+// nsec3Unsupported reports whether denial has NSEC3 records too costly to hash.
+func nsec3Unsupported(denial []dns.RR) bool {
+	return common.Any(denial, func(it dns.RR) bool {
+		nsec3, isNSEC3 := it.(*dns.NSEC3)
+		return isNSEC3 && nsec3.Iterations > dnssecMaxNSEC3Iterations
+	})
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof of RFC 5155 7.2.1, nextCloser is empty without one.
+func nsec3ClosestEncloser(name string, denial []dns.RR) (closestEncloser string, nextCloser string, optOut bool) {
+	var records []*dns.NSEC3
+	for _, record := range denial {
+		if nsec3, isNSEC3 := record.(*dns.NSEC3); isNSEC3 {
+			records = append(records, nsec3)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	candidate := name
+	for {
+		offset, end := dns.NextLabel(candidate, 0)
+		if end {
+			return "", "", false
+		}
+		encloser := candidate[offset:]
+		if common.Any(records, func(it *dns.NSEC3) bool {
+			return it.Match(encloser)
+		}) {
+			for _, record := range records {
+				if record.Cover(candidate) {
+					return encloser, candidate, record.Flags&1 == 1
+				}
+			}
+			return "", "", false
+		}
+		candidate = encloser
+	}
+}
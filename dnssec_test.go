@@ -0,0 +1,195 @@
+package dns_test
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSSEC(t *testing.T) {
+	newKey := func(zone string) (*mDNS.DNSKEY, crypto.Signer) {
+		key := &mDNS.DNSKEY{
+			Hdr:       mDNS.RR_Header{Name: zone, Rrtype: mDNS.TypeDNSKEY, Class: mDNS.ClassINET, Ttl: 3600},
+			Flags:     mDNS.ZONE | mDNS.SEP,
+			Protocol:  3,
+			Algorithm: mDNS.ECDSAP256SHA256,
+		}
+		privateKey, err := key.Generate(256)
+		require.NoError(t, err)
+		return key, privateKey.(crypto.Signer)
+	}
+	sign := func(key *mDNS.DNSKEY, privateKey crypto.Signer, rrset ...mDNS.RR) []mDNS.RR {
+		signature := &mDNS.RRSIG{
+			Hdr:        mDNS.RR_Header{Name: rrset[0].Header().Name, Rrtype: mDNS.TypeRRSIG, Class: mDNS.ClassINET, Ttl: 300},
+			Algorithm:  key.Algorithm,
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: key.Hdr.Name,
+		}
+		require.NoError(t, signature.Sign(privateKey, rrset))
+		return append(rrset, signature)
+	}
+	newRecord := func(record string) mDNS.RR {
+		rr, err := mDNS.NewRR(record)
+		require.NoError(t, err)
+		return rr
+	}
+	rootKey, rootPrivateKey := newKey(".")
+	zoneKey, zonePrivateKey := newKey("example.")
+	badRecord := sign(zoneKey, zonePrivateKey, newRecord("bad.example. 300 IN A 192.0.2.2"))
+	badRecord[0].(*mDNS.A).A = net.IPv4(192, 0, 2, 3)
+	expand := func(wildcard []mDNS.RR, name string) []mDNS.RR {
+		expanded := make([]mDNS.RR, 0, len(wildcard))
+		for _, record := range wildcard {
+			record = mDNS.Copy(record)
+			record.Header().Name = name
+			expanded = append(expanded, record)
+		}
+		return expanded
+	}
+	wildcardRecord := sign(zoneKey, zonePrivateKey, newRecord("*.wild.example. 300 IN A 192.0.2.5"))
+	wildcardDenial := sign(zoneKey, zonePrivateKey, newRecord("*.wild.example. 300 IN NSEC real.wild.example. A RRSIG NSEC"))
+	apexDenial := sign(zoneKey, zonePrivateKey, newRecord("example. 300 IN NSEC bad.example. NS SOA RRSIG NSEC DNSKEY"))
+	hashes := []string{"example.", "bad.example.", "www.example."}
+	for index, name := range hashes {
+		hashes[index] = mDNS.HashName(name, mDNS.SHA1, 0, "CC")
+	}
+	sort.Strings(hashes)
+	var nsec3Chain, nsec3Partial []mDNS.RR
+	for index, hash := range hashes {
+		record := newRecord(hash + ".example. 300 IN NSEC3 1 0 0 CC " + hashes[(index+1)%len(hashes)] + " A RRSIG").(*mDNS.NSEC3)
+		nsec3Chain = append(nsec3Chain, sign(zoneKey, zonePrivateKey, record)...)
+		// the closest encloser proof of partial.example. alone, without the record covering *.example.
+		if record.Match("example.") || record.Cover("partial.example.") {
+			nsec3Partial = append(nsec3Partial, sign(zoneKey, zonePrivateKey, record)...)
+		}
+	}
+	require.False(t, common.Any(nsec3Partial, func(it mDNS.RR) bool {
+		nsec3, isNSEC3 := it.(*mDNS.NSEC3)
+		return isNSEC3 && nsec3.Cover("*.example.")
+	}))
+	responses := map[string]*mDNS.Msg{
+		". DNSKEY":         {Answer: sign(rootKey, rootPrivateKey, rootKey)},
+		"example. DS":      {Answer: sign(rootKey, rootPrivateKey, zoneKey.ToDS(mDNS.SHA256))},
+		"example. DNSKEY":  {Answer: sign(zoneKey, zonePrivateKey, zoneKey)},
+		"www.example. A":   {Answer: sign(zoneKey, zonePrivateKey, newRecord("www.example. 300 IN A 192.0.2.1"))},
+		"bad.example. A":   {Answer: badRecord},
+		"www.example. TXT": {Ns: sign(zoneKey, zonePrivateKey, newRecord("www.example. 300 IN NSEC zzz.example. A RRSIG NSEC"))},
+		"missing.example. A": {
+			MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError},
+			Ns:     append(sign(zoneKey, zonePrivateKey, newRecord("bad.example. 300 IN NSEC www.example. A RRSIG NSEC")), apexDenial...),
+		},
+		// the covering NSEC alone does not prove that *.example. is absent
+		"gone.example. A": {
+			MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError},
+			Ns:     sign(zoneKey, zonePrivateKey, newRecord("bad.example. 300 IN NSEC www.example. A RRSIG NSEC")),
+		},
+		"none.example. A":      {MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError}, Ns: nsec3Chain},
+		"partial.example. A":   {MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError}, Ns: nsec3Partial},
+		"host.wild.example. A": {Answer: expand(wildcardRecord, "host.wild.example."), Ns: wildcardDenial},
+		// a wildcard answer replayed for a name that exists, the denial does not cover it
+		"real.wild.example. A":  {Answer: expand(wildcardRecord, "real.wild.example."), Ns: wildcardDenial},
+		"other.wild.example. A": {Answer: expand(wildcardRecord, "other.wild.example.")},
+		"forged.example. A":     {MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError}},
+		"insecure. DS":          {Ns: sign(rootKey, rootPrivateKey, newRecord("insecure. 300 IN NSEC zzz. NS RRSIG NSEC"))},
+		"host.insecure. A":      {Answer: []mDNS.RR{newRecord("host.insecure. 300 IN A 192.0.2.4")}},
+		// RFC 9276: a chain this costly is not hashed, the zone is treated as unsigned
+		"costly.example. A": {
+			MsgHdr: mDNS.MsgHdr{Rcode: mDNS.RcodeNameError},
+			Ns:     sign(zoneKey, zonePrivateKey, newRecord(hashes[0]+".example. 300 IN NSEC3 1 0 500 CC "+hashes[1]+" A RRSIG")),
+		},
+	}
+	transport := newTestTransport(func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		question := message.Question[0]
+		response := new(mDNS.Msg)
+		response.SetRcode(message, mDNS.RcodeServerFailure)
+		if prepared, loaded := responses[question.Name+" "+mDNS.TypeToString[question.Qtype]]; loaded {
+			response.Rcode = prepared.Rcode
+			response.Answer = prepared.Answer
+			response.Ns = prepared.Ns
+		}
+		if message.IsEdns0() != nil {
+			response.SetEdns0(mDNS.DefaultMsgSize, message.IsEdns0().Do())
+		}
+		return response, nil
+	})
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC: dns.DNSSECOptions{
+			Enabled:      true,
+			TrustAnchors: []*mDNS.DS{rootKey.ToDS(mDNS.SHA256)},
+		},
+	})
+	exchange := func(name string, qType uint16, do bool) *mDNS.Msg {
+		request := new(mDNS.Msg).SetQuestion(name, qType)
+		if do {
+			request.SetEdns0(mDNS.DefaultMsgSize, true)
+		}
+		response, err := client.Exchange(context.Background(), transport, request, dns.DomainStrategyAsIS)
+		require.NoError(t, err)
+		return response
+	}
+
+	response := exchange("www.example.", mDNS.TypeA, false)
+	require.Equal(t, dns.DNSSECSecure, dns.DNSSECStateFromResponse(response))
+	require.Len(t, response.Answer, 1)
+	require.Nil(t, response.IsEdns0())
+	response = exchange("www.example.", mDNS.TypeA, true)
+	require.Len(t, response.Answer, 2)
+	require.True(t, response.IsEdns0().Do())
+	response = exchange("www.example.", mDNS.TypeTXT, false)
+	require.Equal(t, dns.DNSSECSecure, dns.DNSSECStateFromResponse(response))
+	require.Empty(t, response.Ns)
+	for _, name := range []string{"missing.example.", "none.example."} {
+		response = exchange(name, mDNS.TypeA, false)
+		require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+		require.Equal(t, dns.DNSSECSecure, dns.DNSSECStateFromResponse(response))
+	}
+	response = exchange("host.wild.example.", mDNS.TypeA, false)
+	require.Equal(t, dns.DNSSECSecure, dns.DNSSECStateFromResponse(response))
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "host.wild.example.", response.Answer[0].Header().Name)
+
+	for _, name := range []string{"bad.example.", "forged.example.", "gone.example.", "partial.example.", "real.wild.example.", "other.wild.example."} {
+		response = exchange(name, mDNS.TypeA, false)
+		require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+		require.Equal(t, dns.DNSSECBogus, dns.DNSSECStateFromResponse(response))
+	}
+	// bogus answers are cached as SERVFAIL
+	response = exchange("bad.example.", mDNS.TypeA, false)
+	require.Equal(t, mDNS.ExtendedErrorCodeDNSBogus, response.IsEdns0().Option[0].(*mDNS.EDNS0_EDE).InfoCode)
+
+	for _, name := range []string{"host.insecure.", "costly.example."} {
+		response = exchange(name, mDNS.TypeA, false)
+		require.Equal(t, dns.DNSSECInsecure, dns.DNSSECStateFromResponse(response))
+	}
+	require.Len(t, exchange("host.insecure.", mDNS.TypeA, false).Answer, 1)
+
+	request := new(mDNS.Msg).SetQuestion("bad.example.", mDNS.TypeA)
+	request.CheckingDisabled = true
+	response, err := client.Exchange(context.Background(), transport, request, dns.DomainStrategyAsIS)
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+
+	// an on-path attacker strips the DS of example. and replays the denial of a signed delegation
+	responses["example. DS"] = &mDNS.Msg{Ns: sign(rootKey, rootPrivateKey, newRecord("example. 300 IN NSEC zzz. NS DS RRSIG NSEC"))}
+	responses["www.example. A"] = &mDNS.Msg{Answer: []mDNS.RR{newRecord("www.example. 300 IN A 198.51.100.1")}}
+	client = dns.NewClient(dns.ClientOptions{
+		DNSSEC: dns.DNSSECOptions{
+			Enabled:      true,
+			TrustAnchors: []*mDNS.DS{rootKey.ToDS(mDNS.SHA256)},
+		},
+	})
+	response = exchange("www.example.", mDNS.TypeA, false)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	require.Equal(t, dns.DNSSECBogus, dns.DNSSECStateFromResponse(response))
+}
@@ -0,0 +1,33 @@
+package dns
+
+import (
+	"github.com/sagernet/sing/common"
+
+	"github.com/miekg/dns"
+)
+
+const PaddingBlockSize = 128
+
+// PadMessage returns a copy of the query padded to a multiple of PaddingBlockSize, the block-length
+// padding recommended for queries by RFC 8467. Queries already carrying padding are returned as is.
+// Only encrypted transports should pad, padding a plaintext query just makes it larger.
+func PadMessage(message *dns.Msg) *dns.Msg {
+	optRecord := message.IsEdns0()
+	if optRecord != nil && common.Any(optRecord.Option, func(it dns.EDNS0) bool {
+		return it.Option() == dns.EDNS0PADDING
+	}) {
+		return message
+	}
+	message = message.Copy()
+	optRecord = message.IsEdns0()
+	if optRecord == nil {
+		message.SetEdns0(dns.DefaultMsgSize, false)
+		optRecord = message.IsEdns0()
+	}
+	padding := new(dns.EDNS0_PADDING)
+	optRecord.Option = append(optRecord.Option, padding)
+	if remainder := message.Len() % PaddingBlockSize; remainder > 0 {
+		padding.Padding = make([]byte, PaddingBlockSize-remainder)
+	}
+	return message
+}
@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"time"
+
+	"github.com/sagernet/sing/common"
+
+	"github.com/miekg/dns"
+)
+
+// appendTCPKeepalive adds an empty edns-tcp-keepalive option (RFC 7828) to a copy of the message.
+// optAdded reports whether the OPT record was created for it.
+func appendTCPKeepalive(message *dns.Msg) (exMessage *dns.Msg, optAdded bool) {
+	exMessage = new(dns.Msg)
+	*exMessage = *message
+	exMessage.Extra = make([]dns.RR, 0, len(message.Extra)+1)
+	var optRecord *dns.OPT
+	for _, record := range message.Extra {
+		if record.Header().Rrtype == dns.TypeOPT && optRecord == nil {
+			optRecord = dns.Copy(record).(*dns.OPT)
+			if common.Any(optRecord.Option, func(it dns.EDNS0) bool {
+				return it.Option() == dns.EDNS0TCPKEEPALIVE
+			}) {
+				return message, false
+			}
+			record = optRecord
+		}
+		exMessage.Extra = append(exMessage.Extra, record)
+	}
+	if optRecord == nil {
+		optRecord = &dns.OPT{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeOPT,
+			},
+		}
+		optRecord.SetUDPSize(dns.DefaultMsgSize)
+		exMessage.Extra = append(exMessage.Extra, optRecord)
+		optAdded = true
+	}
+	optRecord.Option = append(optRecord.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	})
+	return
+}
+
+// removeTCPKeepalive strips the edns-tcp-keepalive option from a response and returns the idle timeout
+// advertised by the server. When optAdded is set, the whole OPT record is removed.
+func removeTCPKeepalive(response *dns.Msg, optAdded bool) (timeout time.Duration, loaded bool) {
+	for index, record := range response.Extra {
+		optRecord, isOPTRecord := record.(*dns.OPT)
+		if !isOPTRecord {
+			continue
+		}
+		for _, option := range optRecord.Option {
+			if keepaliveOption, isKeepalive := option.(*dns.EDNS0_TCP_KEEPALIVE); isKeepalive {
+				timeout = time.Duration(keepaliveOption.Timeout) * 100 * time.Millisecond
+				loaded = true
+			}
+		}
+		if optAdded {
+			response.Extra = append(response.Extra[:index], response.Extra[index+1:]...)
+		} else if loaded {
+			optRecord.Option = common.Filter(optRecord.Option, func(it dns.EDNS0) bool {
+				return it.Option() != dns.EDNS0TCPKEEPALIVE
+			})
+		}
+		return
+	}
+	return
+}
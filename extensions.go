@@ -54,3 +54,29 @@ func ClientSubnetFromContext(ctx context.Context) (netip.Prefix, bool) {
 	clientSubnet, ok := ctx.Value(clientSubnetKey{}).(netip.Prefix)
 	return clientSubnet, ok
 }
+
+type responseTransportKey struct{}
+
+// contextWithResponseTransport returns a slot for group transports to report the member that answered,
+// which is left empty when the transport answered itself.
+func contextWithResponseTransport(ctx context.Context) (context.Context, *string) {
+	var transportName string
+	return context.WithValue(ctx, responseTransportKey{}, &transportName), &transportName
+}
+
+func setResponseTransport(ctx context.Context, transportName string) {
+	if slot, loaded := ctx.Value(responseTransportKey{}).(*string); loaded {
+		*slot = transportName
+	}
+}
+
+type rdrcRejectedKey struct{}
+
+func contextWithRDRCRejected(ctx context.Context, rejected func(transportName string) bool) context.Context {
+	return context.WithValue(ctx, rdrcRejectedKey{}, rejected)
+}
+
+func rdrcRejectedFromContext(ctx context.Context) (func(transportName string) bool, bool) {
+	rejected, loaded := ctx.Value(rdrcRejectedKey{}).(func(transportName string) bool)
+	return rejected, loaded
+}
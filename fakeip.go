@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// FakeIPStorage persists the mapping between fake addresses and domains,
+// implementations must be safe for concurrent use.
+type FakeIPStorage interface {
+	FakeIPMetadata() *FakeIPMetadata
+	FakeIPSaveMetadata(metadata *FakeIPMetadata) error
+	FakeIPStore(address netip.Addr, domain string) error
+	FakeIPLoad(address netip.Addr) (string, bool)
+	FakeIPLoadDomain(domain string, isIPv6 bool) (netip.Addr, bool)
+	FakeIPReset() error
+}
+
+// FakeIPMetadata records the ranges a storage was filled from and the last addresses handed out.
+type FakeIPMetadata struct {
+	Inet4Range   netip.Prefix
+	Inet6Range   netip.Prefix
+	Inet4Current netip.Addr
+	Inet6Current netip.Addr
+}
+
+var _ FakeIPStorage = (*MemoryFakeIPStorage)(nil)
+
+type MemoryFakeIPStorage struct {
+	access      sync.RWMutex
+	metadata    *FakeIPMetadata
+	domains     map[netip.Addr]string
+	inet4Access map[string]netip.Addr
+	inet6Access map[string]netip.Addr
+}
+
+func NewMemoryFakeIPStorage() *MemoryFakeIPStorage {
+	return &MemoryFakeIPStorage{
+		domains:     make(map[netip.Addr]string),
+		inet4Access: make(map[string]netip.Addr),
+		inet6Access: make(map[string]netip.Addr),
+	}
+}
+
+func (s *MemoryFakeIPStorage) FakeIPMetadata() *FakeIPMetadata {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	if s.metadata == nil {
+		return nil
+	}
+	metadata := *s.metadata
+	return &metadata
+}
+
+func (s *MemoryFakeIPStorage) FakeIPSaveMetadata(metadata *FakeIPMetadata) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	savedMetadata := *metadata
+	s.metadata = &savedMetadata
+	return nil
+}
+
+func (s *MemoryFakeIPStorage) FakeIPStore(address netip.Addr, domain string) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	domainAccess := s.inet4Access
+	if address.Is6() {
+		domainAccess = s.inet6Access
+	}
+	if oldDomain, loaded := s.domains[address]; loaded && domainAccess[oldDomain] == address {
+		delete(domainAccess, oldDomain)
+	}
+	s.domains[address] = domain
+	domainAccess[domain] = address
+	return nil
+}
+
+func (s *MemoryFakeIPStorage) FakeIPLoad(address netip.Addr) (string, bool) {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	domain, loaded := s.domains[address]
+	return domain, loaded
+}
+
+func (s *MemoryFakeIPStorage) FakeIPLoadDomain(domain string, isIPv6 bool) (netip.Addr, bool) {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	var (
+		address netip.Addr
+		loaded  bool
+	)
+	if isIPv6 {
+		address, loaded = s.inet6Access[domain]
+	} else {
+		address, loaded = s.inet4Access[domain]
+	}
+	return address, loaded
+}
+
+func (s *MemoryFakeIPStorage) FakeIPReset() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.metadata = nil
+	s.domains = make(map[netip.Addr]string)
+	s.inet4Access = make(map[string]netip.Addr)
+	s.inet6Access = make(map[string]netip.Addr)
+	return nil
+}
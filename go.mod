@@ -3,10 +3,12 @@ module github.com/sagernet/sing-dns
 go 1.20
 
 require (
+	github.com/cloudflare/circl v1.3.7
 	github.com/miekg/dns v1.1.61
 	github.com/sagernet/quic-go v0.45.1-beta.2
 	github.com/sagernet/sing v0.4.2
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/crypto v0.25.0
 )
 
 require (
@@ -17,7 +19,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/quic-go/qpack v0.4.0 // indirect
 	github.com/quic-go/qtls-go1-20 v0.4.1 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56 // indirect
 	golang.org/x/mod v0.19.0 // indirect
 	golang.org/x/net v0.27.0 // indirect
@@ -0,0 +1,365 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultPipelineMaxConnections          = 4
+	DefaultPipelineMaxQueriesPerConnection = 64
+	DefaultPipelineIdleTimeout             = 10 * time.Second
+)
+
+// PipelineOptions controls RFC 7766 query pipelining on stream transports.
+type PipelineOptions struct {
+	MaxConnections          int
+	MaxQueriesPerConnection int
+	IdleTimeout             time.Duration
+	DisableKeepalive        bool
+}
+
+type pipelinePool struct {
+	dial           func(ctx context.Context) (net.Conn, error)
+	maxConnections int
+	maxQueries     int
+	idleTimeout    time.Duration
+	keepalive      bool
+	padding        bool
+	access         sync.Mutex
+	connections    []*pipelineConnection
+	dials          []*pipelineDial
+}
+
+// pipelineDial is a connection being dialed, it counts toward MaxConnections until it completes.
+type pipelineDial struct {
+	done chan struct{}
+	conn *pipelineConnection
+	err  error
+}
+
+// newPipelinePool creates a pool, padding is for encrypted transports and applies to the query as written.
+func newPipelinePool(options PipelineOptions, padding bool, dial func(ctx context.Context) (net.Conn, error)) *pipelinePool {
+	pool := &pipelinePool{
+		dial:           dial,
+		maxConnections: options.MaxConnections,
+		maxQueries:     options.MaxQueriesPerConnection,
+		idleTimeout:    options.IdleTimeout,
+		keepalive:      !options.DisableKeepalive,
+		padding:        padding,
+	}
+	if pool.maxConnections <= 0 {
+		pool.maxConnections = DefaultPipelineMaxConnections
+	}
+	if pool.maxQueries <= 0 {
+		pool.maxQueries = DefaultPipelineMaxQueriesPerConnection
+	}
+	if pool.idleTimeout <= 0 {
+		pool.idleTimeout = DefaultPipelineIdleTimeout
+	}
+	return pool
+}
+
+func (p *pipelinePool) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, fresh, err := p.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err := conn.exchange(ctx, message)
+		if err == nil || fresh || ctx.Err() != nil || !common.Done(conn.ctx) {
+			return response, err
+		}
+		// the server closed a reused connection before answering, retry on another one
+	}
+}
+
+func (p *pipelinePool) acquire(ctx context.Context) (*pipelineConnection, bool, error) {
+	for {
+		conn, dial, wait := p.pick(ctx)
+		if conn != nil {
+			return conn, false, nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if dial != nil {
+			return dial.conn, true, dial.err
+		}
+	}
+}
+
+// pick returns the least loaded connection, or starts a dial when the pool may grow. Otherwise it
+// returns a channel closed once a pending dial completes or a draining connection goes away.
+func (p *pipelinePool) pick(ctx context.Context) (*pipelineConnection, *pipelineDial, <-chan struct{}) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	var bestConn *pipelineConnection
+	bestQueries := -1
+	connections := p.connections[:0]
+	for _, conn := range p.connections {
+		if common.Done(conn.ctx) {
+			continue
+		}
+		connections = append(connections, conn)
+		queries, draining := conn.queries()
+		if draining {
+			continue
+		}
+		if bestConn == nil || queries < bestQueries {
+			bestConn = conn
+			bestQueries = queries
+		}
+	}
+	common.ClearArray(p.connections[len(connections):])
+	p.connections = connections
+	full := len(p.connections)+len(p.dials) >= p.maxConnections
+	if bestConn != nil && (bestQueries < p.maxQueries || full) {
+		return bestConn, nil, nil
+	}
+	if !full {
+		dial := p.startDial(ctx)
+		return nil, dial, dial.done
+	}
+	if len(p.dials) > 0 {
+		return nil, nil, p.dials[0].done
+	}
+	return nil, nil, p.connections[0].ctx.Done()
+}
+
+// startDial must be called with access held. The dial outlives the query that started it, as other
+// queries may be waiting for it.
+func (p *pipelinePool) startDial(ctx context.Context) *pipelineDial {
+	dial := &pipelineDial{done: make(chan struct{})}
+	p.dials = append(p.dials, dial)
+	go func() {
+		dialCtx, cancel := context.WithTimeout(valueContext{ctx}, DefaultTimeout)
+		conn, err := p.dial(dialCtx)
+		cancel()
+		p.access.Lock()
+		pending := common.Contains(p.dials, dial)
+		if pending {
+			p.dials = common.Filter(p.dials, func(it *pipelineDial) bool {
+				return it != dial
+			})
+		}
+		if err == nil && !pending {
+			// the pool was reset while dialing
+			conn.Close()
+			err = net.ErrClosed
+		}
+		if err == nil {
+			dial.conn = newPipelineConnection(conn, p.idleTimeout, p.keepalive, p.padding)
+			p.connections = append(p.connections, dial.conn)
+		} else {
+			dial.err = err
+		}
+		p.access.Unlock()
+		close(dial.done)
+	}()
+	return dial
+}
+
+func (p *pipelinePool) Reset() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, conn := range p.connections {
+		conn.Close()
+	}
+	p.connections = nil
+	p.dials = nil
+}
+
+// valueContext keeps the values of a context but drops its cancellation.
+type valueContext struct {
+	context.Context
+}
+
+func (c valueContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c valueContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c valueContext) Err() error {
+	return nil
+}
+
+type pipelineConnection struct {
+	net.Conn
+	ctx         context.Context
+	cancel      context.CancelFunc
+	keepalive   bool
+	padding     bool
+	writeAccess sync.Mutex
+	access      sync.Mutex
+	err         error
+	queryId     uint16
+	callbacks   map[uint16]*dnsCallback
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	draining    bool
+}
+
+func newPipelineConnection(conn net.Conn, idleTimeout time.Duration, keepalive bool, padding bool) *pipelineConnection {
+	ctx, cancel := context.WithCancel(context.Background())
+	connection := &pipelineConnection{
+		Conn:        conn,
+		ctx:         ctx,
+		cancel:      cancel,
+		keepalive:   keepalive,
+		padding:     padding,
+		callbacks:   make(map[uint16]*dnsCallback),
+		idleTimeout: idleTimeout,
+	}
+	connection.idleTimer = time.AfterFunc(idleTimeout, connection.closeIfIdle)
+	go connection.recvLoop()
+	return connection
+}
+
+func (c *pipelineConnection) queries() (queries int, draining bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return len(c.callbacks), c.draining
+}
+
+// updateIdleTimeout applies the idle timeout advertised by the server, a zero timeout asks
+// the client to close the connection once outstanding queries are answered.
+func (c *pipelineConnection) updateIdleTimeout(timeout time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if timeout == 0 {
+		c.draining = true
+	} else if timeout < c.idleTimeout {
+		c.idleTimeout = timeout
+	}
+}
+
+func (c *pipelineConnection) closeIfIdle() {
+	c.access.Lock()
+	idle := len(c.callbacks) == 0
+	c.access.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+func (c *pipelineConnection) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	callback := &dnsCallback{
+		done: make(chan struct{}),
+	}
+	c.access.Lock()
+	for {
+		c.queryId++
+		if _, loaded := c.callbacks[c.queryId]; !loaded {
+			break
+		}
+	}
+	queryId := c.queryId
+	c.callbacks[queryId] = callback
+	c.idleTimer.Stop()
+	c.access.Unlock()
+	defer func() {
+		c.access.Lock()
+		if c.callbacks[queryId] == callback {
+			delete(c.callbacks, queryId)
+		}
+		var closeNow bool
+		if len(c.callbacks) == 0 {
+			if c.draining {
+				closeNow = true
+			} else {
+				c.idleTimer.Reset(c.idleTimeout)
+			}
+		}
+		c.access.Unlock()
+		if closeNow {
+			c.Close()
+		}
+	}()
+	exMessage := message
+	var optAdded bool
+	if c.keepalive {
+		exMessage, optAdded = appendTCPKeepalive(message)
+	}
+	if c.padding {
+		// padded last and measured compressed, as writeMessage packs it
+		compressedMessage := *exMessage
+		compressedMessage.Compress = true
+		exMessage = PadMessage(&compressedMessage)
+	}
+	c.writeAccess.Lock()
+	err := writeMessage(c.Conn, queryId, exMessage)
+	c.writeAccess.Unlock()
+	if err != nil {
+		c.closeWithError(err)
+		return nil, E.Cause(err, "write request")
+	}
+	select {
+	case <-callback.done:
+		response := callback.message
+		if c.keepalive {
+			if timeout, loaded := removeTCPKeepalive(response, optAdded); loaded {
+				c.updateIdleTimeout(timeout)
+			}
+		}
+		response.Id = message.Id
+		return response, nil
+	case <-c.ctx.Done():
+		return nil, E.Cause(c.err, "read response")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipelineConnection) recvLoop() {
+	for {
+		message, err := readMessage(c.Conn)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		c.access.Lock()
+		callback, loaded := c.callbacks[message.Id]
+		if loaded {
+			delete(c.callbacks, message.Id)
+		}
+		c.access.Unlock()
+		if !loaded {
+			continue
+		}
+		callback.message = message
+		close(callback.done)
+	}
+}
+
+func (c *pipelineConnection) closeWithError(err error) {
+	c.access.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.access.Unlock()
+	c.Close()
+}
+
+func (c *pipelineConnection) Close() error {
+	c.access.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.access.Unlock()
+	c.idleTimer.Stop()
+	c.cancel()
+	return c.Conn.Close()
+}
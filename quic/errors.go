@@ -0,0 +1,82 @@
+package quic
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/sagernet/quic-go"
+)
+
+// ErrorCode is a DoQ application error code, carried by connection closes and stream resets (RFC 9250 4.3).
+type ErrorCode uint64
+
+const (
+	ErrorCodeNoError          ErrorCode = 0x0
+	ErrorCodeInternalError    ErrorCode = 0x1
+	ErrorCodeProtocolError    ErrorCode = 0x2
+	ErrorCodeRequestCancelled ErrorCode = 0x3
+	ErrorCodeExcessiveLoad    ErrorCode = 0x4
+	ErrorCodeUnspecifiedError ErrorCode = 0x5
+	ErrorCodeErrorReserved    ErrorCode = 0xd098ea5e
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeNoError:
+		return "DOQ_NO_ERROR"
+	case ErrorCodeInternalError:
+		return "DOQ_INTERNAL_ERROR"
+	case ErrorCodeProtocolError:
+		return "DOQ_PROTOCOL_ERROR"
+	case ErrorCodeRequestCancelled:
+		return "DOQ_REQUEST_CANCELLED"
+	case ErrorCodeExcessiveLoad:
+		return "DOQ_EXCESSIVE_LOAD"
+	case ErrorCodeUnspecifiedError:
+		return "DOQ_UNSPECIFIED_ERROR"
+	case ErrorCodeErrorReserved:
+		return "DOQ_ERROR_RESERVED"
+	default:
+		return "0x" + strconv.FormatUint(uint64(c), 16)
+	}
+}
+
+// Error is a DoQ error, either received from the server or raised for a response violating the protocol.
+// Stream errors only failed the query, the connection is still usable.
+type Error struct {
+	Code   ErrorCode
+	Remote bool
+	Stream bool
+	cause  error
+}
+
+func (e *Error) Error() string {
+	message := e.Code.String()
+	if e.Remote {
+		message += " from server"
+	}
+	if e.cause != nil && !e.Remote {
+		message += ": " + e.cause.Error()
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+func newProtocolError(cause error) *Error {
+	return &Error{Code: ErrorCodeProtocolError, cause: cause}
+}
+
+func wrapError(err error) error {
+	var applicationErr *quic.ApplicationError
+	if errors.As(err, &applicationErr) && applicationErr.ErrorCode != 0 {
+		return &Error{Code: ErrorCode(applicationErr.ErrorCode), Remote: applicationErr.Remote, cause: err}
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return &Error{Code: ErrorCode(streamErr.ErrorCode), Remote: streamErr.Remote, Stream: true, cause: err}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package quic
+
+import (
+	"context"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing-dns"
+)
+
+const (
+	defaultKeepAlivePeriod = 10 * time.Second
+	keepWarmMinDelay       = time.Second
+	keepWarmMaxDelay       = time.Minute
+	backoffMinDelay        = time.Second
+	backoffMaxDelay        = time.Minute
+)
+
+func newQUICConfig(options dns.QUICOptions, defaultConfig *quic.Config) *quic.Config {
+	config := defaultConfig.Clone()
+	if options.HandshakeTimeout > 0 {
+		config.HandshakeIdleTimeout = options.HandshakeTimeout
+	}
+	if options.MaxIdleTimeout > 0 {
+		config.MaxIdleTimeout = options.MaxIdleTimeout
+	}
+	if options.KeepAlivePeriod > 0 {
+		config.KeepAlivePeriod = options.KeepAlivePeriod
+	} else if options.KeepAlivePeriod < 0 {
+		config.KeepAlivePeriod = 0
+	} else if options.KeepWarm && config.KeepAlivePeriod == 0 {
+		config.KeepAlivePeriod = defaultKeepAlivePeriod
+	}
+	if options.MaxIncomingStreams != 0 {
+		config.MaxIncomingStreams = options.MaxIncomingStreams
+	}
+	return config
+}
+
+// keepWarm dials through open whenever the previous connection is lost, backing off while dialing fails.
+func keepWarm(ctx context.Context, open func() (quic.Connection, error)) {
+	delay := keepWarmMinDelay
+	for {
+		conn, err := open()
+		if err == nil {
+			delay = keepWarmMinDelay
+			select {
+			case <-conn.Context().Done():
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			delay *= 2
+			if delay > keepWarmMaxDelay {
+				delay = keepWarmMaxDelay
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
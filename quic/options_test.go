@@ -0,0 +1,50 @@
+package quic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing-dns"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICConfig(t *testing.T) {
+	http3Config := &quic.Config{
+		MaxIncomingStreams: -1,
+	}
+	doqConfig := &quic.Config{
+		MaxIncomingStreams:    -1,
+		MaxIncomingUniStreams: -1,
+	}
+
+	// no keepalives unless asked for, they keep the radio of mobile devices awake
+	config := newQUICConfig(dns.QUICOptions{}, http3Config)
+	require.Zero(t, config.KeepAlivePeriod)
+	require.Equal(t, int64(-1), config.MaxIncomingStreams)
+	require.Zero(t, config.HandshakeIdleTimeout)
+	require.Zero(t, config.MaxIdleTimeout)
+	config = newQUICConfig(dns.QUICOptions{KeepWarm: true}, http3Config)
+	require.Equal(t, defaultKeepAlivePeriod, config.KeepAlivePeriod)
+	require.Zero(t, http3Config.KeepAlivePeriod)
+
+	config = newQUICConfig(dns.QUICOptions{}, doqConfig)
+	require.Zero(t, config.KeepAlivePeriod)
+	require.Equal(t, int64(-1), config.MaxIncomingUniStreams)
+	config = newQUICConfig(dns.QUICOptions{KeepWarm: true}, doqConfig)
+	require.Equal(t, defaultKeepAlivePeriod, config.KeepAlivePeriod)
+	config = newQUICConfig(dns.QUICOptions{KeepWarm: true, KeepAlivePeriod: -1}, doqConfig)
+	require.Zero(t, config.KeepAlivePeriod)
+
+	config = newQUICConfig(dns.QUICOptions{
+		HandshakeTimeout:   time.Second,
+		MaxIdleTimeout:     time.Minute,
+		KeepAlivePeriod:    5 * time.Second,
+		MaxIncomingStreams: 8,
+	}, doqConfig)
+	require.Equal(t, time.Second, config.HandshakeIdleTimeout)
+	require.Equal(t, time.Minute, config.MaxIdleTimeout)
+	require.Equal(t, 5*time.Second, config.KeepAlivePeriod)
+	require.Equal(t, int64(8), config.MaxIncomingStreams)
+}
@@ -1,18 +1,19 @@
 package quic
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"io"
+	"errors"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
+	"sync"
 
 	"github.com/sagernet/quic-go"
 	"github.com/sagernet/quic-go/http3"
 	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -32,8 +33,14 @@ func init() {
 
 type HTTP3Transport struct {
 	name        string
+	ctx         context.Context
+	cancel      context.CancelFunc
 	destination string
+	options     dns.HTTPOptions
+	keepWarm    bool
 	transport   *http3.RoundTripper
+	access      sync.Mutex
+	connection  quic.EarlyConnection
 }
 
 func NewHTTP3Transport(options dns.TransportOptions) (*HTTP3Transport, error) {
@@ -41,24 +48,37 @@ func NewHTTP3Transport(options dns.TransportOptions) (*HTTP3Transport, error) {
 	if err != nil {
 		return nil, err
 	}
-	serverURL.Scheme = "https"
-	return &HTTP3Transport{
+	ctx, cancel := context.WithCancel(options.Context)
+	transport := &HTTP3Transport{
 		name:        options.Name,
-		destination: serverURL.String(),
-		transport: &http3.RoundTripper{
-			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-				destinationAddr := M.ParseSocksaddr(addr)
-				conn, dialErr := options.Dialer.DialContext(ctx, N.NetworkUDP, destinationAddr)
-				if dialErr != nil {
-					return nil, dialErr
-				}
-				return quic.DialEarly(ctx, bufio.NewUnbindPacketConn(conn), conn.RemoteAddr(), tlsCfg, cfg)
-			},
-			TLSClientConfig: &tls.Config{
-				NextProtos: []string{"dns"},
-			},
+		ctx:         ctx,
+		cancel:      cancel,
+		destination: "https" + options.Address[len(serverURL.Scheme):],
+		options:     options.HTTP,
+		keepWarm:    options.QUIC.KeepWarm,
+	}
+	transport.transport = &http3.RoundTripper{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			destinationAddr := M.ParseSocksaddr(addr)
+			conn, dialErr := options.Dialer.DialContext(ctx, N.NetworkUDP, destinationAddr)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			earlyConnection, dialErr := quic.DialEarly(ctx, bufio.NewUnbindPacketConn(conn), conn.RemoteAddr(), tlsCfg, cfg)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			transport.access.Lock()
+			transport.connection = earlyConnection
+			transport.access.Unlock()
+			return earlyConnection, nil
 		},
-	}, nil
+		TLSClientConfig: dns.NewTLSConfig(options, serverURL.Hostname(), []string{"dns"}),
+		QUICConfig: newQUICConfig(options.QUIC, &quic.Config{
+			MaxIncomingStreams: -1,
+		}),
+	}
+	return transport, nil
 }
 
 func (t *HTTP3Transport) Name() string {
@@ -66,6 +86,9 @@ func (t *HTTP3Transport) Name() string {
 }
 
 func (t *HTTP3Transport) Start() error {
+	if t.keepWarm {
+		go keepWarm(t.ctx, t.warmUp)
+	}
 	return nil
 }
 
@@ -74,9 +97,26 @@ func (t *HTTP3Transport) Reset() {
 }
 
 func (t *HTTP3Transport) Close() error {
+	t.cancel()
 	return t.transport.Close()
 }
 
+// warmUp opens a connection the only way the round tripper allows, by sending a ". NS" query through it,
+// one extra query to the upstream per reconnect.
+func (t *HTTP3Transport) warmUp() (quic.Connection, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, dns.DefaultTimeout)
+	defer cancel()
+	_, err := t.Exchange(ctx, new(mDNS.Msg).SetQuestion(".", mDNS.TypeNS))
+	t.access.Lock()
+	connection := t.connection
+	t.access.Unlock()
+	// the connection is warm even if the upstream refused the query
+	if connection == nil || common.Done(connection.Context()) {
+		return nil, E.Errors(err, os.ErrClosed)
+	}
+	return connection, nil
+}
+
 func (t *HTTP3Transport) Raw() bool {
 	return true
 }
@@ -85,48 +125,35 @@ func (t *HTTP3Transport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS
 	exMessage := *message
 	exMessage.Id = 0
 	exMessage.Compress = true
-	requestBuffer := buf.NewSize(1 + message.Len())
-	rawMessage, err := exMessage.PackBuffer(requestBuffer.FreeBytes())
+	paddedMessage := dns.PadMessage(&exMessage)
+	requestBuffer := buf.NewSize(1 + paddedMessage.Len())
+	rawMessage, err := paddedMessage.PackBuffer(requestBuffer.FreeBytes())
 	if err != nil {
 		requestBuffer.Release()
 		return nil, err
 	}
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.destination, bytes.NewReader(rawMessage))
+	request, err := dns.NewHTTPRequest(ctx, t.options, t.destination, rawMessage)
 	if err != nil {
 		requestBuffer.Release()
 		return nil, err
 	}
-	request.Header.Set("Content-Type", dns.MimeType)
-	request.Header.Set("Accept", dns.MimeType)
-	response, err := t.transport.RoundTrip(request)
-	requestBuffer.Release()
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		return nil, E.New("unexpected status: ", response.Status)
-	}
-	var responseMessage mDNS.Msg
-	if response.ContentLength > 0 {
-		responseBuffer := buf.NewSize(int(response.ContentLength))
-		_, err = responseBuffer.ReadFullFrom(response.Body, int(response.ContentLength))
-		if err != nil {
-			return nil, err
+	var response *http.Response
+	if request.Method == http.MethodGet {
+		// GET is idempotent and may be sent as 0-RTT data on resumed connections
+		earlyRequest := *request
+		earlyRequest.Method = http3.MethodGet0RTT
+		response, err = t.transport.RoundTrip(&earlyRequest)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			response, err = t.transport.RoundTrip(request)
 		}
-		err = responseMessage.Unpack(responseBuffer.Bytes())
-		responseBuffer.Release()
 	} else {
-		rawMessage, err = io.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
-		err = responseMessage.Unpack(rawMessage)
+		response, err = t.transport.RoundTrip(request)
 	}
+	requestBuffer.Release()
 	if err != nil {
 		return nil, err
 	}
-	return &responseMessage, nil
+	return dns.ReadHTTPResponse(response)
 }
 
 func (t *HTTP3Transport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
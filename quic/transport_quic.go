@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/sagernet/quic-go"
 	"github.com/sagernet/sing-dns"
@@ -33,11 +34,19 @@ func init() {
 type Transport struct {
 	name       string
 	ctx        context.Context
+	cancel     context.CancelFunc
 	dialer     N.Dialer
 	serverAddr M.Socksaddr
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	keepWarm   bool
 
 	access     sync.Mutex
 	connection quic.EarlyConnection
+
+	backoffAccess sync.Mutex
+	backoffDelay  time.Duration
+	backoffUntil  time.Time
 }
 
 func NewTransport(options dns.TransportOptions) (*Transport, error) {
@@ -52,11 +61,20 @@ func NewTransport(options dns.TransportOptions) (*Transport, error) {
 	if serverAddr.Port == 0 {
 		serverAddr.Port = 853
 	}
+	ctx, cancel := context.WithCancel(options.Context)
 	return &Transport{
 		name:       options.Name,
-		ctx:        options.Context,
+		ctx:        ctx,
+		cancel:     cancel,
 		dialer:     options.Dialer,
 		serverAddr: serverAddr,
+		tlsConfig:  dns.NewTLSConfig(options, serverAddr.AddrString(), []string{"doq"}),
+		quicConfig: newQUICConfig(options.QUIC, &quic.Config{
+			// DoQ servers never open streams
+			MaxIncomingStreams:    -1,
+			MaxIncomingUniStreams: -1,
+		}),
+		keepWarm: options.QUIC.KeepWarm,
 	}, nil
 }
 
@@ -65,6 +83,11 @@ func (t *Transport) Name() string {
 }
 
 func (t *Transport) Start() error {
+	if t.keepWarm {
+		go keepWarm(t.ctx, func() (quic.Connection, error) {
+			return t.openConnection()
+		})
+	}
 	return nil
 }
 
@@ -76,6 +99,7 @@ func (t *Transport) Reset() {
 }
 
 func (t *Transport) Close() error {
+	t.cancel()
 	t.Reset()
 	return nil
 }
@@ -103,8 +127,8 @@ func (t *Transport) openConnection() (quic.EarlyConnection, error) {
 		t.ctx,
 		bufio.NewUnbindPacketConn(conn),
 		t.serverAddr.UDPAddr(),
-		&tls.Config{ServerName: t.serverAddr.AddrString(), NextProtos: []string{"doq"}},
-		nil,
+		t.tlsConfig,
+		t.quicConfig,
 	)
 	if err != nil {
 		return nil, err
@@ -114,10 +138,14 @@ func (t *Transport) openConnection() (quic.EarlyConnection, error) {
 }
 
 func (t *Transport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+	err := t.backoffError()
+	if err != nil {
+		return nil, err
+	}
 	var (
-		conn     quic.Connection
-		err      error
+		conn     quic.EarlyConnection
 		response *mDNS.Msg
+		doqErr   *Error
 	)
 	for i := 0; i < 2; i++ {
 		conn, err = t.openConnection()
@@ -125,44 +153,112 @@ func (t *Transport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg,
 			return nil, err
 		}
 		response, err = t.exchange(ctx, message, conn)
-		if err == nil {
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// the connection survives a rejected 0-RTT attempt, the query is resent once the handshake completes
+			var nextConn quic.Connection
+			nextConn, err = conn.NextConnection(ctx)
+			if err == nil {
+				response, err = t.exchange(ctx, message, nextConn)
+			}
+		}
+		switch {
+		case err == nil:
+			t.resetBackoff()
 			return response, nil
-		} else if !isQUICRetryError(err) {
+		case errors.As(err, &doqErr) && doqErr.Code == ErrorCodeExcessiveLoad:
+			// retrying at once would only add to the load the server is shedding
+			t.backoff()
+			return nil, err
+		case errors.As(err, &doqErr) && doqErr.Code == ErrorCodeProtocolError && !doqErr.Remote:
+			conn.CloseWithError(quic.ApplicationErrorCode(ErrorCodeProtocolError), "")
+			return nil, err
+		case errors.As(err, &doqErr):
+			return nil, err
+		case isQUICRetryError(err):
+			conn.CloseWithError(quic.ApplicationErrorCode(ErrorCodeNoError), "")
+		default:
 			return nil, err
-		} else {
-			conn.CloseWithError(quic.ApplicationErrorCode(0), "")
-			continue
 		}
 	}
 	return nil, err
 }
 
+func (t *Transport) backoffError() error {
+	t.backoffAccess.Lock()
+	defer t.backoffAccess.Unlock()
+	if remaining := time.Until(t.backoffUntil); remaining > 0 {
+		return &Error{Code: ErrorCodeExcessiveLoad, cause: E.New("backing off for ", remaining.Round(time.Millisecond))}
+	}
+	return nil
+}
+
+func (t *Transport) backoff() {
+	t.backoffAccess.Lock()
+	defer t.backoffAccess.Unlock()
+	t.backoffDelay *= 2
+	if t.backoffDelay < backoffMinDelay {
+		t.backoffDelay = backoffMinDelay
+	} else if t.backoffDelay > backoffMaxDelay {
+		t.backoffDelay = backoffMaxDelay
+	}
+	t.backoffUntil = time.Now().Add(t.backoffDelay)
+}
+
+func (t *Transport) resetBackoff() {
+	t.backoffAccess.Lock()
+	t.backoffDelay = 0
+	t.backoffAccess.Unlock()
+}
+
 func (t *Transport) exchange(ctx context.Context, message *mDNS.Msg, conn quic.Connection) (*mDNS.Msg, error) {
+	if earlyConn, isEarly := conn.(quic.EarlyConnection); isEarly && message.Opcode != mDNS.OpcodeQuery {
+		// only queries are safe to replay, anything else waits to leave 0-RTT
+		select {
+		case <-earlyConn.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	// RFC 9250 4.2.1: the message ID is always 0 and edns-tcp-keepalive must not be sent
 	exMessage := *message
 	exMessage.Id = 0
-	requestLen := exMessage.Len()
+	exMessage.Extra = removeTCPKeepalive(message.Extra)
+	paddedMessage := dns.PadMessage(&exMessage)
+	requestLen := paddedMessage.Len()
 	buffer := buf.NewSize(3 + requestLen)
 	defer buffer.Release()
 	common.Must(binary.Write(buffer, binary.BigEndian, uint16(requestLen)))
-	rawMessage, err := exMessage.PackBuffer(buffer.FreeBytes())
+	rawMessage, err := paddedMessage.PackBuffer(buffer.FreeBytes())
 	if err != nil {
 		return nil, err
 	}
 	buffer.Truncate(2 + len(rawMessage))
 	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
-	defer stream.Close()
-	defer stream.CancelRead(0)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.CancelWrite(quic.StreamErrorCode(ErrorCodeRequestCancelled))
+			stream.CancelRead(quic.StreamErrorCode(ErrorCodeRequestCancelled))
+		case <-done:
+			stream.CancelRead(quic.StreamErrorCode(ErrorCodeNoError))
+		}
+	}()
 	_, err = stream.Write(buffer.Bytes())
-	if err != nil {
-		return nil, err
+	if err == nil {
+		// the query is the only message on the stream, FIN is sent right after it
+		err = stream.Close()
+	}
+	if err == nil {
+		buffer.Reset()
+		_, err = buffer.ReadFullFrom(stream, 2)
 	}
-	buffer.Reset()
-	_, err = buffer.ReadFullFrom(stream, 2)
 	if err != nil {
-		return nil, err
+		return nil, exchangeError(ctx, err)
 	}
 	responseLen := int(binary.BigEndian.Uint16(buffer.Bytes()))
 	buffer.Reset()
@@ -172,16 +268,58 @@ func (t *Transport) exchange(ctx context.Context, message *mDNS.Msg, conn quic.C
 	}
 	_, err = buffer.ReadFullFrom(stream, responseLen)
 	if err != nil {
-		return nil, err
+		return nil, exchangeError(ctx, err)
 	}
 	var responseMessage mDNS.Msg
 	err = responseMessage.Unpack(buffer.Bytes())
 	if err != nil {
 		return nil, err
 	}
+	if responseMessage.Id != 0 {
+		return nil, newProtocolError(E.New("response ID ", responseMessage.Id))
+	}
+	if hasTCPKeepalive(responseMessage.Extra) {
+		return nil, newProtocolError(E.New("edns-tcp-keepalive in response"))
+	}
+	responseMessage.Id = message.Id
 	return &responseMessage, nil
 }
 
+func exchangeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return wrapError(err)
+}
+
+func hasTCPKeepalive(extra []mDNS.RR) bool {
+	return common.Any(extra, func(it mDNS.RR) bool {
+		optRecord, isOPT := it.(*mDNS.OPT)
+		return isOPT && common.Any(optRecord.Option, isTCPKeepalive)
+	})
+}
+
+func removeTCPKeepalive(extra []mDNS.RR) []mDNS.RR {
+	if !hasTCPKeepalive(extra) {
+		return extra
+	}
+	return common.Map(extra, func(it mDNS.RR) mDNS.RR {
+		optRecord, isOPT := it.(*mDNS.OPT)
+		if !isOPT {
+			return it
+		}
+		optRecord = mDNS.Copy(optRecord).(*mDNS.OPT)
+		optRecord.Option = common.Filter(optRecord.Option, func(it mDNS.EDNS0) bool {
+			return !isTCPKeepalive(it)
+		})
+		return optRecord
+	})
+}
+
+func isTCPKeepalive(option mDNS.EDNS0) bool {
+	return option.Option() == mDNS.EDNS0TCPKEEPALIVE
+}
+
 func (t *Transport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
 	return nil, os.ErrInvalid
 }
@@ -0,0 +1,211 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing-dns"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCode(t *testing.T) {
+	require.Equal(t, "DOQ_EXCESSIVE_LOAD", ErrorCodeExcessiveLoad.String())
+	require.Equal(t, "DOQ_ERROR_RESERVED", ErrorCodeErrorReserved.String())
+	require.Equal(t, "0x42", ErrorCode(0x42).String())
+}
+
+func TestWrapError(t *testing.T) {
+	var doqErr *Error
+	err := wrapError(&quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(ErrorCodeExcessiveLoad), Remote: true})
+	require.ErrorAs(t, err, &doqErr)
+	require.Equal(t, ErrorCodeExcessiveLoad, doqErr.Code)
+	require.True(t, doqErr.Remote)
+	require.False(t, doqErr.Stream)
+	require.Equal(t, "DOQ_EXCESSIVE_LOAD from server", err.Error())
+
+	err = wrapError(&quic.StreamError{ErrorCode: quic.StreamErrorCode(ErrorCodeRequestCancelled)})
+	require.ErrorAs(t, err, &doqErr)
+	require.Equal(t, ErrorCodeRequestCancelled, doqErr.Code)
+	require.False(t, doqErr.Remote)
+	require.True(t, doqErr.Stream)
+
+	// a graceful close is left for isQUICRetryError
+	applicationErr := &quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(ErrorCodeNoError), Remote: true}
+	require.Same(t, applicationErr, wrapError(applicationErr))
+	require.True(t, isQUICRetryError(wrapError(applicationErr)))
+	require.Equal(t, os.ErrClosed, wrapError(os.ErrClosed))
+
+	err = newProtocolError(os.ErrInvalid)
+	require.ErrorIs(t, err, os.ErrInvalid)
+	require.Equal(t, "DOQ_PROTOCOL_ERROR: "+os.ErrInvalid.Error(), err.Error())
+}
+
+func TestBackoff(t *testing.T) {
+	var doqErr *Error
+	transport := &Transport{}
+	require.NoError(t, transport.backoffError())
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for _, delay := range expected {
+		transport.backoff()
+		require.Equal(t, delay, transport.backoffDelay)
+		require.ErrorAs(t, transport.backoffError(), &doqErr)
+		require.Equal(t, ErrorCodeExcessiveLoad, doqErr.Code)
+		require.False(t, doqErr.Remote)
+	}
+	transport.resetBackoff()
+	require.Zero(t, transport.backoffDelay)
+	transport.backoff()
+	require.Equal(t, time.Second, transport.backoffDelay)
+	transport.backoffUntil = time.Now().Add(-time.Millisecond)
+	require.NoError(t, transport.backoffError())
+}
+
+func TestTransportResponse(t *testing.T) {
+	var queries atomic.Int32
+	serverAddr := newTestServer(t, func(stream quic.Stream, request *mDNS.Msg) *mDNS.Msg {
+		queries.Add(1)
+		response := new(mDNS.Msg).SetReply(request)
+		switch request.Question[0].Name {
+		case "id.test.":
+			response.Id = 1
+		case "keepalive.test.":
+			response.SetEdns0(mDNS.DefaultMsgSize, false)
+			optRecord := response.IsEdns0()
+			optRecord.Option = append(optRecord.Option, &mDNS.EDNS0_TCP_KEEPALIVE{Code: mDNS.EDNS0TCPKEEPALIVE})
+		case "load.test.":
+			stream.CancelWrite(quic.StreamErrorCode(ErrorCodeExcessiveLoad))
+			return nil
+		}
+		return response
+	})
+	transport, err := NewTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Address: "quic://" + serverAddr,
+		Dialer:  N.SystemDialer,
+		TLS:     dns.TLSOptions{Insecure: true},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	exchange := func(name string) (*mDNS.Msg, error) {
+		request := new(mDNS.Msg).SetQuestion(name, mDNS.TypeA)
+		request.Id = 1234
+		request.SetEdns0(mDNS.DefaultMsgSize, false)
+		optRecord := request.IsEdns0()
+		optRecord.Option = append(optRecord.Option, &mDNS.EDNS0_TCP_KEEPALIVE{Code: mDNS.EDNS0TCPKEEPALIVE})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return transport.Exchange(ctx, request)
+	}
+
+	response, err := exchange("example.test.")
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), response.Id)
+
+	var doqErr *Error
+	for _, name := range []string{"id.test.", "keepalive.test."} {
+		connection := transport.connection
+		_, err = exchange(name)
+		require.ErrorAs(t, err, &doqErr)
+		require.Equal(t, ErrorCodeProtocolError, doqErr.Code)
+		require.False(t, doqErr.Remote)
+		// the connection is closed with DOQ_PROTOCOL_ERROR and replaced by the next query
+		var applicationErr *quic.ApplicationError
+		require.ErrorAs(t, context.Cause(connection.Context()), &applicationErr)
+		require.Equal(t, quic.ApplicationErrorCode(ErrorCodeProtocolError), applicationErr.ErrorCode)
+		_, err = exchange("example.test.")
+		require.NoError(t, err)
+		require.NotSame(t, connection, transport.connection)
+	}
+
+	_, err = exchange("load.test.")
+	require.ErrorAs(t, err, &doqErr)
+	require.Equal(t, ErrorCodeExcessiveLoad, doqErr.Code)
+	require.True(t, doqErr.Remote)
+	require.True(t, doqErr.Stream)
+	exchanges := queries.Load()
+	_, err = exchange("example.test.")
+	require.ErrorAs(t, err, &doqErr)
+	require.False(t, doqErr.Remote)
+	require.Equal(t, exchanges, queries.Load())
+}
+
+func newTestServer(t *testing.T, handler func(stream quic.Stream, request *mDNS.Msg) *mDNS.Msg) string {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	rawCertificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{rawCertificate}, PrivateKey: privateKey}},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{Allow0RTT: true})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			connection, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := connection.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveTestStream(stream, handler)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTestStream(stream quic.Stream, handler func(stream quic.Stream, request *mDNS.Msg) *mDNS.Msg) {
+	// the client sends FIN after its query, so the whole stream is the message
+	rawRequest, err := io.ReadAll(stream)
+	if err != nil || len(rawRequest) < 2 {
+		stream.CancelWrite(quic.StreamErrorCode(ErrorCodeProtocolError))
+		return
+	}
+	var request mDNS.Msg
+	err = request.Unpack(rawRequest[2:])
+	if err != nil || request.Id != 0 || hasTCPKeepalive(request.Extra) {
+		stream.CancelWrite(quic.StreamErrorCode(ErrorCodeProtocolError))
+		return
+	}
+	response := handler(stream, &request)
+	if response == nil {
+		return
+	}
+	rawResponse, err := response.Pack()
+	if err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(ErrorCodeInternalError))
+		return
+	}
+	_, _ = stream.Write(binary.BigEndian.AppendUint16(rawResponse[:0:0], uint16(len(rawResponse))))
+	_, _ = stream.Write(rawResponse)
+	_ = stream.Close()
+}
@@ -0,0 +1,441 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const StampScheme = "sdns://"
+
+type StampProtocol uint8
+
+const (
+	StampProtocolPlain         StampProtocol = 0x00
+	StampProtocolDNSCrypt      StampProtocol = 0x01
+	StampProtocolDoH           StampProtocol = 0x02
+	StampProtocolDoT           StampProtocol = 0x03
+	StampProtocolDoQ           StampProtocol = 0x04
+	StampProtocolODoHTarget    StampProtocol = 0x05
+	StampProtocolDNSCryptRelay StampProtocol = 0x81
+	StampProtocolODoHRelay     StampProtocol = 0x85
+)
+
+func (p StampProtocol) String() string {
+	switch p {
+	case StampProtocolPlain:
+		return "plain"
+	case StampProtocolDNSCrypt:
+		return "dnscrypt"
+	case StampProtocolDoH:
+		return "doh"
+	case StampProtocolDoT:
+		return "dot"
+	case StampProtocolDoQ:
+		return "doq"
+	case StampProtocolODoHTarget:
+		return "odoh-target"
+	case StampProtocolDNSCryptRelay:
+		return "dnscrypt-relay"
+	case StampProtocolODoHRelay:
+		return "odoh-relay"
+	default:
+		return F.ToString(uint8(p))
+	}
+}
+
+const (
+	StampPropertyDNSSEC   uint64 = 1 << 0
+	StampPropertyNoLog    uint64 = 1 << 1
+	StampPropertyNoFilter uint64 = 1 << 2
+)
+
+// Stamp is a decoded DNS stamp, see https://dnscrypt.info/stamps-specifications.
+// Hashes are SHA256 digests of TBS certificates, Hostname may carry a port.
+type Stamp struct {
+	Protocol        StampProtocol
+	Properties      uint64
+	ServerAddress   string
+	ServerPublicKey []byte
+	ProviderName    string
+	Hashes          [][]byte
+	Hostname        string
+	Path            string
+	Bootstrap       []string
+}
+
+func init() {
+	RegisterTransport([]string{"sdns"}, func(options TransportOptions) (Transport, error) {
+		stamp, err := ParseStamp(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		switch stamp.Protocol {
+		case StampProtocolDNSCrypt:
+			return newDNSCryptTransport(options, stamp)
+		case StampProtocolDNSCryptRelay, StampProtocolODoHRelay:
+			return nil, E.New(stamp.Protocol, " stamp can not be used as an upstream")
+		}
+		options, err = stamp.transportOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		constructor := transports[serverURL.Scheme]
+		if constructor == nil {
+			return nil, E.New("transport for ", stamp.Protocol, " stamp is not registered")
+		}
+		return constructor(options)
+	})
+}
+
+func ParseStamp(content string) (*Stamp, error) {
+	if !strings.HasPrefix(content, StampScheme) {
+		return nil, E.New("stamp must start with ", StampScheme)
+	}
+	rawStamp, err := base64.RawURLEncoding.DecodeString(content[len(StampScheme):])
+	if err != nil {
+		return nil, E.Cause(err, "decode stamp")
+	}
+	if len(rawStamp) < 1 {
+		return nil, E.New("stamp too short")
+	}
+	stamp := &Stamp{
+		Protocol: StampProtocol(rawStamp[0]),
+	}
+	reader := stampReader(rawStamp[1:])
+	if stamp.Protocol != StampProtocolDNSCryptRelay {
+		if len(reader) < 8 {
+			return nil, E.New("stamp too short")
+		}
+		stamp.Properties = binary.LittleEndian.Uint64(reader)
+		reader = reader[8:]
+	}
+	switch stamp.Protocol {
+	case StampProtocolPlain, StampProtocolDNSCryptRelay:
+		stamp.ServerAddress, err = reader.readString()
+	case StampProtocolDNSCrypt:
+		stamp.ServerAddress, err = reader.readString()
+		if err == nil {
+			stamp.ServerPublicKey, err = reader.readBytes()
+		}
+		if err == nil {
+			stamp.ProviderName, err = reader.readString()
+		}
+	case StampProtocolDoH, StampProtocolDoT, StampProtocolDoQ, StampProtocolODoHRelay:
+		stamp.ServerAddress, err = reader.readString()
+		if err == nil {
+			stamp.Hashes, err = reader.readBytesList()
+		}
+		if err == nil {
+			stamp.Hostname, err = reader.readString()
+		}
+		if err == nil && (stamp.Protocol == StampProtocolDoH || stamp.Protocol == StampProtocolODoHRelay) {
+			stamp.Path, err = reader.readString()
+		}
+		if err == nil && len(reader) > 0 {
+			var bootstrap [][]byte
+			bootstrap, err = reader.readBytesList()
+			for _, server := range bootstrap {
+				stamp.Bootstrap = append(stamp.Bootstrap, string(server))
+			}
+		}
+	case StampProtocolODoHTarget:
+		stamp.Hostname, err = reader.readString()
+		if err == nil {
+			stamp.Path, err = reader.readString()
+		}
+	default:
+		return nil, E.New("unsupported stamp protocol: ", stamp.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reader) > 0 {
+		return nil, E.New("invalid stamp: trailing data")
+	}
+	return stamp, nil
+}
+
+// NewStamp describes an existing transport configuration as a DNS stamp.
+// Options a stamp can not carry, such as public key pins, are rejected instead of being dropped.
+func NewStamp(options TransportOptions) (*Stamp, error) {
+	if strings.HasPrefix(options.Address, StampScheme) {
+		return ParseStamp(options.Address)
+	}
+	if options.TLS.Insecure || len(options.TLS.PinnedPublicKeySHA256) > 0 {
+		return nil, E.New("insecure mode and public key pins can not be expressed in a stamp")
+	}
+	serverURL, err := url.Parse(options.Address)
+	if err != nil || serverURL.Scheme == "" {
+		serverURL = &url.URL{Host: options.Address}
+	}
+	stamp := &Stamp{
+		Hashes: options.TLS.PinnedCertificateSHA256,
+	}
+	var defaultPort uint16
+	switch serverURL.Scheme {
+	case "", "udp", "tcp":
+		stamp.Protocol = StampProtocolPlain
+		defaultPort = 53
+	case "tls":
+		stamp.Protocol = StampProtocolDoT
+		defaultPort = 853
+	case "quic":
+		stamp.Protocol = StampProtocolDoQ
+		defaultPort = 853
+	case "https":
+		stamp.Protocol = StampProtocolDoH
+		defaultPort = 443
+		stamp.Path = serverURL.EscapedPath()
+		if stamp.Path == "" {
+			stamp.Path = "/"
+		}
+		if serverURL.RawQuery != "" {
+			stamp.Path += "?" + serverURL.RawQuery
+		}
+	case "odoh":
+		stamp.Protocol = StampProtocolODoHTarget
+		defaultPort = 443
+		stamp.Path = serverURL.EscapedPath()
+		if stamp.Path == "" {
+			stamp.Path = "/dns-query"
+		}
+	default:
+		return nil, E.New("transport can not be expressed in a stamp: ", serverURL.Scheme)
+	}
+	serverAddr := M.ParseSocksaddr(serverURL.Host)
+	if !serverAddr.IsValid() {
+		return nil, E.New("invalid server address")
+	}
+	if serverAddr.Port == defaultPort {
+		serverAddr.Port = 0
+	}
+	switch stamp.Protocol {
+	case StampProtocolPlain:
+		stamp.ServerAddress = formatStampAddress(serverAddr)
+		return stamp, nil
+	case StampProtocolODoHTarget:
+		if len(stamp.Hashes) > 0 || options.TLS.ServerName != "" && options.TLS.ServerName != serverAddr.AddrString() {
+			return nil, E.New("ODoH target stamps can not carry certificate hashes or a server name")
+		}
+		stamp.Hashes = nil
+		stamp.Hostname = formatStampAddress(serverAddr)
+		return stamp, nil
+	}
+	stamp.Hostname = options.TLS.ServerName
+	if serverAddr.IsIP() {
+		stamp.ServerAddress = formatStampAddress(serverAddr)
+		if stamp.Hostname == "" {
+			stamp.Hostname = serverAddr.AddrString()
+		}
+	} else if stamp.Hostname == "" || stamp.Hostname == serverAddr.Fqdn {
+		stamp.Hostname = formatStampAddress(serverAddr)
+	} else {
+		return nil, E.New("server name differs from server host name")
+	}
+	return stamp, nil
+}
+
+func (s *Stamp) String() string {
+	rawStamp := []byte{byte(s.Protocol)}
+	if s.Protocol != StampProtocolDNSCryptRelay {
+		rawStamp = binary.LittleEndian.AppendUint64(rawStamp, s.Properties)
+	}
+	switch s.Protocol {
+	case StampProtocolPlain, StampProtocolDNSCryptRelay:
+		rawStamp = appendStampBytes(rawStamp, []byte(s.ServerAddress))
+	case StampProtocolDNSCrypt:
+		rawStamp = appendStampBytes(rawStamp, []byte(s.ServerAddress))
+		rawStamp = appendStampBytes(rawStamp, s.ServerPublicKey)
+		rawStamp = appendStampBytes(rawStamp, []byte(s.ProviderName))
+	case StampProtocolDoH, StampProtocolDoT, StampProtocolDoQ, StampProtocolODoHRelay:
+		rawStamp = appendStampBytes(rawStamp, []byte(s.ServerAddress))
+		rawStamp = appendStampBytesList(rawStamp, s.Hashes)
+		rawStamp = appendStampBytes(rawStamp, []byte(s.Hostname))
+		if s.Protocol == StampProtocolDoH || s.Protocol == StampProtocolODoHRelay {
+			rawStamp = appendStampBytes(rawStamp, []byte(s.Path))
+		}
+		if len(s.Bootstrap) > 0 {
+			bootstrap := make([][]byte, 0, len(s.Bootstrap))
+			for _, server := range s.Bootstrap {
+				bootstrap = append(bootstrap, []byte(server))
+			}
+			rawStamp = appendStampBytesList(rawStamp, bootstrap)
+		}
+	case StampProtocolODoHTarget:
+		rawStamp = appendStampBytes(rawStamp, []byte(s.Hostname))
+		rawStamp = appendStampBytes(rawStamp, []byte(s.Path))
+	}
+	return StampScheme + base64.RawURLEncoding.EncodeToString(rawStamp)
+}
+
+// transportOptions rewrites options to address the registered transport the stamp describes.
+// When the stamp carries an IP address it is dialed directly and the host name is only used for SNI and Host.
+func (s *Stamp) transportOptions(options TransportOptions) (TransportOptions, error) {
+	var (
+		scheme      string
+		defaultPort uint16
+	)
+	switch s.Protocol {
+	case StampProtocolPlain:
+		serverAddr := s.serverAddr(53)
+		if !serverAddr.IsValid() {
+			return options, E.New("invalid server address")
+		}
+		options.Address = "udp://" + serverAddr.String()
+		return options, nil
+	case StampProtocolDoH, StampProtocolODoHRelay:
+		scheme, defaultPort = "https", 443
+	case StampProtocolDoT:
+		scheme, defaultPort = "tls", 853
+	case StampProtocolDoQ:
+		scheme, defaultPort = "quic", 853
+	case StampProtocolODoHTarget:
+		scheme, defaultPort = "odoh", 443
+	default:
+		return options, E.New("unsupported stamp protocol: ", s.Protocol)
+	}
+	hostAddr := parseStampAddress(s.Hostname, defaultPort)
+	if !hostAddr.IsValid() {
+		return options, E.New("invalid stamp host name")
+	}
+	serverAddr := s.serverAddr(hostAddr.Port)
+	if !serverAddr.IsValid() {
+		serverAddr = hostAddr
+	}
+	if options.TLS.ServerName == "" {
+		options.TLS.ServerName = hostAddr.AddrString()
+	}
+	for _, hash := range s.Hashes {
+		if len(hash) > 0 {
+			options.TLS.PinnedCertificateSHA256 = append(options.TLS.PinnedCertificateSHA256, hash)
+		}
+	}
+	options.Address = scheme + "://" + serverAddr.String()
+	if scheme == "https" || scheme == "odoh" {
+		path := s.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		options.Address += path
+		if serverAddr != hostAddr {
+			options.HTTP.Headers = options.HTTP.Headers.Clone()
+			if options.HTTP.Headers == nil {
+				options.HTTP.Headers = make(http.Header)
+			}
+			if hostAddr.Port == 443 {
+				options.HTTP.Headers.Set("Host", hostAddr.AddrString())
+			} else {
+				options.HTTP.Headers.Set("Host", hostAddr.String())
+			}
+		}
+	}
+	return options, nil
+}
+
+// serverAddr parses ServerAddress, which may be empty or hold only a port.
+func (s *Stamp) serverAddr(defaultPort uint16) M.Socksaddr {
+	if strings.HasPrefix(s.ServerAddress, ":") {
+		return M.Socksaddr{}
+	}
+	return parseStampAddress(s.ServerAddress, defaultPort)
+}
+
+func parseStampAddress(address string, defaultPort uint16) M.Socksaddr {
+	if address == "" {
+		return M.Socksaddr{}
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	} else if port, parseErr := strconv.ParseUint(portString, 10, 16); parseErr == nil {
+		defaultPort = uint16(port)
+	} else {
+		return M.Socksaddr{}
+	}
+	if addr, parseErr := netip.ParseAddr(host); parseErr == nil {
+		return M.SocksaddrFrom(addr, defaultPort)
+	}
+	return M.Socksaddr{Fqdn: host, Port: defaultPort}
+}
+
+func formatStampAddress(serverAddr M.Socksaddr) string {
+	if serverAddr.Port != 0 {
+		return serverAddr.String()
+	}
+	if serverAddr.IsIPv6() {
+		return "[" + serverAddr.AddrString() + "]"
+	}
+	return serverAddr.AddrString()
+}
+
+type stampReader []byte
+
+func (r *stampReader) readBytes() ([]byte, error) {
+	if len(*r) < 1 {
+		return nil, E.New("invalid stamp: unexpected end")
+	}
+	length := int((*r)[0])
+	if len(*r) < 1+length {
+		return nil, E.New("invalid stamp: unexpected end")
+	}
+	content := (*r)[1 : 1+length]
+	*r = (*r)[1+length:]
+	return content, nil
+}
+
+func (r *stampReader) readString() (string, error) {
+	content, err := r.readBytes()
+	return string(content), err
+}
+
+// readBytesList reads a set of strings whose length bytes flag a following element with 0x80.
+func (r *stampReader) readBytesList() ([][]byte, error) {
+	var list [][]byte
+	for {
+		if len(*r) < 1 {
+			return nil, E.New("invalid stamp: unexpected end")
+		}
+		more := (*r)[0]&0x80 != 0
+		length := int((*r)[0] & 0x7f)
+		if len(*r) < 1+length {
+			return nil, E.New("invalid stamp: unexpected end")
+		}
+		list = append(list, (*r)[1:1+length])
+		*r = (*r)[1+length:]
+		if !more {
+			return list, nil
+		}
+	}
+}
+
+func appendStampBytes(rawStamp []byte, content []byte) []byte {
+	return append(append(rawStamp, byte(len(content))), content...)
+}
+
+func appendStampBytesList(rawStamp []byte, list [][]byte) []byte {
+	if len(list) == 0 {
+		return append(rawStamp, 0)
+	}
+	for index, content := range list {
+		length := byte(len(content))
+		if index < len(list)-1 {
+			length |= 0x80
+		}
+		rawStamp = append(append(rawStamp, length), content...)
+	}
+	return rawStamp
+}
@@ -0,0 +1,100 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStamp(t *testing.T) {
+	for _, testCase := range []struct {
+		content string
+		expect  dns.Stamp
+	}{
+		{"sdns://AAcAAAAAAAAABzguOC44Ljg", dns.Stamp{Protocol: dns.StampProtocolPlain, Properties: 7, ServerAddress: "8.8.8.8"}},
+		{"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", dns.Stamp{
+			Protocol: dns.StampProtocolDoH, Properties: 7, ServerAddress: "1.0.0.1",
+			Hashes: [][]byte{{}}, Hostname: "dns.cloudflare.com", Path: "/dns-query",
+		}},
+		{"sdns://AwcAAAAAAAAABzEuMS4xLjEAD29uZS5vbmUub25lLm9uZQ", dns.Stamp{
+			Protocol: dns.StampProtocolDoT, Properties: 7, ServerAddress: "1.1.1.1",
+			Hashes: [][]byte{{}}, Hostname: "one.one.one.one",
+		}},
+	} {
+		stamp, err := dns.ParseStamp(testCase.content)
+		require.NoError(t, err)
+		require.Equal(t, testCase.expect, *stamp)
+		require.Equal(t, testCase.content, stamp.String())
+	}
+	stamp, err := dns.NewStamp(dns.TransportOptions{
+		Address: "https://1.1.1.1:8443/dns-query",
+		TLS:     dns.TLSOptions{ServerName: "one.one.one.one", PinnedCertificateSHA256: [][]byte{make([]byte, 32)}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, dns.Stamp{
+		Protocol: dns.StampProtocolDoH, ServerAddress: "1.1.1.1:8443",
+		Hashes: [][]byte{make([]byte, 32)}, Hostname: "one.one.one.one", Path: "/dns-query",
+	}, *stamp)
+	parsedStamp, err := dns.ParseStamp(stamp.String())
+	require.NoError(t, err)
+	require.Equal(t, stamp, parsedStamp)
+	_, err = dns.NewStamp(dns.TransportOptions{Address: "tls://1.1.1.1", TLS: dns.TLSOptions{Insecure: true}})
+	require.Error(t, err)
+}
+
+func TestStampTransport(t *testing.T) {
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		if request.Host != "example.com" || request.URL.Path != "/dns-query" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	certificateHash := sha256.Sum256(server.Certificate().RawTBSCertificate)
+	for _, testCase := range []struct {
+		name    string
+		hash    []byte
+		success bool
+	}{
+		{"pinned", certificateHash[:], true},
+		{"bad pin", make([]byte, 32), false},
+	} {
+		stamp := dns.Stamp{
+			Protocol:      dns.StampProtocolDoH,
+			ServerAddress: strings.TrimPrefix(server.URL, "https://"),
+			Hashes:        [][]byte{testCase.hash},
+			Hostname:      "example.com",
+			Path:          "/dns-query",
+		}
+		success := testCase.success
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: stamp.String(),
+				Dialer:  N.SystemDialer,
+				TLS:     dns.TLSOptions{RootCAs: rootCAs},
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+			if success {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "pinned certificate hashes")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+type TLSOptions struct {
+	ServerName            string
+	Insecure              bool
+	MinVersion            uint16
+	MaxVersion            uint16
+	RootCAs               *x509.CertPool
+	Certificates          []tls.Certificate
+	PinnedPublicKeySHA256 [][]byte
+	// PinnedCertificateSHA256 holds SHA256 hashes of TBS certificates, as carried by DNS stamps.
+	PinnedCertificateSHA256 [][]byte
+	// DisableSessionResumption stops reconnects from resuming TLS sessions, which also disables QUIC 0-RTT.
+	DisableSessionResumption bool
+}
+
+const tlsSessionCacheSize = 8
+
+// NewTLSConfig builds the client configuration shared by all encrypted transports.
+// Certificate verification is done in VerifyConnection so that errors name the upstream.
+func NewTLSConfig(options TransportOptions, serverName string, nextProtos []string) *tls.Config {
+	tlsOptions := options.TLS
+	if tlsOptions.ServerName != "" {
+		serverName = tlsOptions.ServerName
+	}
+	upstream := options.Name
+	if upstream == "" {
+		upstream = redactAddress(options.Address)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tlsOptions.MinVersion,
+		MaxVersion:         tlsOptions.MaxVersion,
+		Certificates:       tlsOptions.Certificates,
+		NextProtos:         nextProtos,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyConnection(upstream, tlsOptions, serverName, state)
+		},
+	}
+	if !tlsOptions.DisableSessionResumption {
+		// the cache belongs to the transport, tickets are never shared between upstreams
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	}
+	return tlsConfig
+}
+
+// redactAddress strips the userinfo from upstream URLs, so that credentials never reach error messages.
+func redactAddress(address string) string {
+	serverURL, err := url.Parse(address)
+	if err != nil || serverURL.User == nil {
+		return address
+	}
+	serverURL.User = nil
+	return serverURL.String()
+}
+
+func verifyConnection(upstream string, options TLSOptions, serverName string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return E.New("upstream ", upstream, ": no peer certificate")
+	}
+	if !options.Insecure {
+		verifyOptions := x509.VerifyOptions{
+			Roots:         options.RootCAs,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, certificate := range state.PeerCertificates[1:] {
+			verifyOptions.Intermediates.AddCert(certificate)
+		}
+		_, err := state.PeerCertificates[0].Verify(verifyOptions)
+		if err != nil {
+			return E.Cause(err, "upstream ", upstream, ": verify certificate")
+		}
+	}
+	if len(options.PinnedPublicKeySHA256) > 0 && !matchCertificateHash(state.PeerCertificates, options.PinnedPublicKeySHA256, func(certificate *x509.Certificate) []byte {
+		return certificate.RawSubjectPublicKeyInfo
+	}) {
+		return E.New("upstream ", upstream, ": no certificate matches pinned public keys")
+	}
+	if len(options.PinnedCertificateSHA256) > 0 && !matchCertificateHash(state.PeerCertificates, options.PinnedCertificateSHA256, func(certificate *x509.Certificate) []byte {
+		return certificate.RawTBSCertificate
+	}) {
+		return E.New("upstream ", upstream, ": no certificate matches pinned certificate hashes")
+	}
+	return nil
+}
+
+func matchCertificateHash(certificates []*x509.Certificate, pinnedHashes [][]byte, content func(certificate *x509.Certificate) []byte) bool {
+	for _, certificate := range certificates {
+		hash := sha256.Sum256(content(certificate))
+		for _, pinnedHash := range pinnedHashes {
+			if bytes.Equal(hash[:], pinnedHash) {
+				return true
+			}
+		}
+	}
+	return false
+}
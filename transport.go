@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/netip"
 	"net/url"
+	"time"
 
 	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/logger"
@@ -31,6 +32,44 @@ type TransportOptions struct {
 	Dialer       N.Dialer
 	Address      string
 	ClientSubnet netip.Prefix
+	TLS          TLSOptions
+	Pipeline     PipelineOptions
+	UDP          UDPOptions
+	QUIC         QUICOptions
+	HTTP         HTTPOptions
+	ODoH         ODoHOptions
+	Hosts        HostsOptions
+	FakeIP       FakeIPOptions
+	Zone         ZoneOptions
+	Block        BlockOptions
+	Group        GroupOptions
+	Health       HealthOptions
+	Bootstrap    BootstrapOptions
+}
+
+// UDPOptions controls how often UDPTransport replaces its socket, zero disables the limit.
+// DNS cookies are sent unless disabled, StrictCookie rejects responses echoing another client cookie.
+// RandomizeCase enables DNS 0x20, the letters of the query name are sent in random case and must be echoed.
+// Upstreams found not to echo the case are queried as is until the transport is reset.
+type UDPOptions struct {
+	MaxQueriesPerConnection int
+	MaxConnectionLifetime   time.Duration
+	DisableCookie           bool
+	StrictCookie            bool
+	RandomizeCase           bool
+}
+
+// QUICOptions tunes DoQ and DoH3 connections. Zero timeouts keep the quic-go defaults, and a zero
+// MaxIncomingStreams keeps the server from opening streams. A zero KeepAlivePeriod sends no keepalives,
+// or pings every 10 seconds with KeepWarm; a negative one disables them. KeepWarm redials in the
+// background once the connection is lost, so that the first query after an idle period or a network
+// change does not pay for the handshake. DoH3 can only dial by sending a request, so it queries ". NS".
+type QUICOptions struct {
+	HandshakeTimeout   time.Duration
+	MaxIdleTimeout     time.Duration
+	KeepAlivePeriod    time.Duration
+	MaxIncomingStreams int64
+	KeepWarm           bool
 }
 
 var transports map[string]TransportConstructor
@@ -58,12 +97,26 @@ func CreateTransport(options TransportOptions) (Transport, error) {
 		return nil, E.New("unknown DNS server format: " + options.Address)
 	}
 	options.Context = contextWithTransportName(options.Context, options.Name)
+	var bootstrapDialer *bootstrapDialer
+	if options.Bootstrap.Transport != nil || len(options.Bootstrap.Addresses) > 0 {
+		bootstrapDialer = newBootstrapDialer(options.Dialer, options.Bootstrap)
+		options.Dialer = bootstrapDialer
+	}
 	transport, err := constructor(options)
 	if err != nil {
 		return nil, err
 	}
+	if bootstrapDialer != nil {
+		transport = &bootstrapTransportWrapper{transport, bootstrapDialer}
+	}
 	if options.ClientSubnet.IsValid() {
 		transport = &edns0SubnetTransportWrapper{transport, options.ClientSubnet}
 	}
+	if options.Health.Enabled {
+		transport, err = NewHealthTransport(options.Context, options.Logger, transport, options.Health)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return transport, nil
 }
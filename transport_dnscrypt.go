@@ -0,0 +1,493 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305" //nolint:staticcheck
+)
+
+const (
+	DNSCryptXSalsa20Poly1305  uint16 = 0x0001
+	DNSCryptXChaCha20Poly1305 uint16 = 0x0002
+)
+
+const (
+	dnscryptCertificateSize     = 124
+	dnscryptClientMagicSize     = 8
+	dnscryptHalfNonceSize       = 12
+	dnscryptNonceSize           = 24
+	dnscryptTagSize             = 16
+	dnscryptQueryOverhead       = dnscryptClientMagicSize + 32 + dnscryptHalfNonceSize + dnscryptTagSize
+	dnscryptResponseHeaderSize  = 8 + dnscryptNonceSize
+	dnscryptMinQueryLen         = 256
+	dnscryptMaxQueryLen         = 4096
+	dnscryptCertificateLifetime = time.Hour
+)
+
+var (
+	dnscryptCertificateMagic = []byte("DNSC")
+	dnscryptResolverMagic    = []byte("r6fnvWj8")
+)
+
+var _ Transport = (*DNSCryptTransport)(nil)
+
+type DNSCryptTransport struct {
+	name          string
+	dialer        N.Dialer
+	logger        logger.ContextLogger
+	serverAddr    M.Socksaddr
+	providerName  string
+	providerKey   ed25519.PublicKey
+	certTransport *UDPTransport
+	publicKey     [32]byte
+	secretKey     [32]byte
+	minQueryLen   atomic.Int32
+	access        sync.Mutex
+	certificate   *dnscryptCertificate
+}
+
+type dnscryptCertificate struct {
+	construction uint16
+	serial       uint32
+	clientMagic  [dnscryptClientMagicSize]byte
+	sharedKey    [32]byte
+	notAfter     time.Time
+	refreshAt    time.Time
+}
+
+func NewDNSCryptTransport(options TransportOptions) (*DNSCryptTransport, error) {
+	stamp, err := ParseStamp(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	if stamp.Protocol != StampProtocolDNSCrypt {
+		return nil, E.New("not a DNSCrypt stamp: ", stamp.Protocol)
+	}
+	return newDNSCryptTransport(options, stamp)
+}
+
+func newDNSCryptTransport(options TransportOptions, stamp *Stamp) (*DNSCryptTransport, error) {
+	serverAddr := stamp.serverAddr(443)
+	if !serverAddr.IsValid() {
+		return nil, E.New("invalid server address")
+	}
+	if len(stamp.ServerPublicKey) != ed25519.PublicKeySize {
+		return nil, E.New("invalid provider public key")
+	}
+	if stamp.ProviderName == "" {
+		return nil, E.New("missing provider name")
+	}
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	certOptions := options
+	certOptions.Address = serverAddr.String()
+	certTransport, err := NewUDPTransport(certOptions)
+	if err != nil {
+		return nil, err
+	}
+	transport := &DNSCryptTransport{
+		name:          options.Name,
+		dialer:        options.Dialer,
+		logger:        options.Logger,
+		serverAddr:    serverAddr,
+		providerName:  dns.Fqdn(stamp.ProviderName),
+		providerKey:   ed25519.PublicKey(stamp.ServerPublicKey),
+		certTransport: certTransport,
+		publicKey:     *publicKey,
+		secretKey:     *secretKey,
+	}
+	transport.minQueryLen.Store(dnscryptMinQueryLen)
+	return transport, nil
+}
+
+func (t *DNSCryptTransport) Name() string {
+	return t.name
+}
+
+func (t *DNSCryptTransport) Start() error {
+	return nil
+}
+
+func (t *DNSCryptTransport) Reset() {
+	t.certTransport.Reset()
+}
+
+func (t *DNSCryptTransport) Close() error {
+	return t.certTransport.Close()
+}
+
+func (t *DNSCryptTransport) Raw() bool {
+	return true
+}
+
+func (t *DNSCryptTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	certificate, err := t.loadCertificate(ctx)
+	if err != nil {
+		return nil, E.Cause(err, "fetch DNSCrypt certificate")
+	}
+	response, err := t.exchange(ctx, N.NetworkUDP, certificate, message)
+	if err != nil {
+		return nil, err
+	}
+	if response.Truncated {
+		if minQueryLen := t.minQueryLen.Load(); minQueryLen < dnscryptMaxQueryLen {
+			t.minQueryLen.CompareAndSwap(minQueryLen, minQueryLen+64)
+		}
+		t.logger.InfoContext(ctx, "response truncated, retrying with TCP")
+		return t.exchange(ctx, N.NetworkTCP, certificate, message)
+	}
+	return response, nil
+}
+
+func (t *DNSCryptTransport) exchange(ctx context.Context, network string, certificate *dnscryptCertificate, message *dns.Msg) (*dns.Msg, error) {
+	rawMessage, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	paddedLen := dnscryptQueryOverhead + len(rawMessage) + 1
+	if network == N.NetworkUDP {
+		if minQueryLen := int(t.minQueryLen.Load()); paddedLen < minQueryLen {
+			paddedLen = minQueryLen
+		}
+	} else {
+		var extraPadding [1]byte
+		common.Must1(rand.Read(extraPadding[:]))
+		paddedLen += int(extraPadding[0])
+	}
+	paddedLen = (paddedLen + 63) &^ 63
+	if paddedLen > dnscryptMaxQueryLen {
+		paddedLen = dnscryptMaxQueryLen
+	}
+	if dnscryptQueryOverhead+len(rawMessage)+1 > paddedLen {
+		return nil, E.New("DNSCrypt query too large")
+	}
+	var nonce [dnscryptNonceSize]byte
+	common.Must1(rand.Read(nonce[:dnscryptHalfNonceSize]))
+	query := make([]byte, 0, paddedLen)
+	query = append(query, certificate.clientMagic[:]...)
+	query = append(query, t.publicKey[:]...)
+	query = append(query, nonce[:dnscryptHalfNonceSize]...)
+	query = dnscryptSeal(certificate.construction, query, nonce, dnscryptPad(rawMessage, paddedLen-dnscryptQueryOverhead), &certificate.sharedKey)
+	conn, err := t.dialer.DialContext(ctx, network, t.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, loaded := ctx.Deadline()
+	if !loaded {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	var rawResponse []byte
+	if network == N.NetworkUDP {
+		_, err = conn.Write(query)
+		if err != nil {
+			return nil, err
+		}
+		buffer := buf.NewSize(dns.MaxMsgSize)
+		defer buffer.Release()
+		for {
+			buffer.Reset()
+			_, err = buffer.ReadOnceFrom(conn)
+			if err != nil {
+				return nil, err
+			}
+			rawResponse, err = dnscryptOpen(certificate, nonce, buffer.Bytes())
+			if err == nil {
+				break
+			}
+			// ignore packets that are not encrypted for us
+		}
+	} else {
+		err = common.Error(conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)))
+		if err != nil {
+			return nil, err
+		}
+		var responseLen uint16
+		err = binary.Read(conn, binary.BigEndian, &responseLen)
+		if err != nil {
+			return nil, err
+		}
+		encryptedResponse := make([]byte, responseLen)
+		_, err = io.ReadFull(conn, encryptedResponse)
+		if err != nil {
+			return nil, err
+		}
+		rawResponse, err = dnscryptOpen(certificate, nonce, encryptedResponse)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var response dns.Msg
+	err = response.Unpack(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *DNSCryptTransport) loadCertificate(ctx context.Context) (*dnscryptCertificate, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	certificate := t.certificate
+	if certificate != nil && time.Now().Before(certificate.refreshAt) {
+		return certificate, nil
+	}
+	newCertificate, err := t.fetchCertificate(ctx)
+	if err != nil {
+		if certificate != nil && time.Now().Before(certificate.notAfter) {
+			t.logger.WarnContext(ctx, E.Cause(err, "refresh DNSCrypt certificate"))
+			return certificate, nil
+		}
+		return nil, err
+	}
+	t.certificate = newCertificate
+	return newCertificate, nil
+}
+
+func (t *DNSCryptTransport) fetchCertificate(ctx context.Context) (*dnscryptCertificate, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(t.providerName, dns.TypeTXT)
+	response, err := t.certTransport.Exchange(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, RCodeError(response.Rcode)
+	}
+	var (
+		certificate *dnscryptCertificate
+		lastErr     error
+	)
+	now := time.Now()
+	for _, record := range response.Answer {
+		txtRecord, isTXT := record.(*dns.TXT)
+		if !isTXT {
+			continue
+		}
+		newCertificate, parseErr := t.parseCertificate(unescapeTXT(strings.Join(txtRecord.Txt, "")), now)
+		if parseErr != nil {
+			lastErr = parseErr
+			continue
+		}
+		if certificate == nil || newCertificate.serial > certificate.serial ||
+			newCertificate.serial == certificate.serial && newCertificate.construction > certificate.construction {
+			certificate = newCertificate
+		}
+	}
+	if certificate == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, E.New("no certificate found for ", t.providerName)
+	}
+	return certificate, nil
+}
+
+func (t *DNSCryptTransport) parseCertificate(rawCertificate []byte, now time.Time) (*dnscryptCertificate, error) {
+	if len(rawCertificate) < dnscryptCertificateSize || !bytes.Equal(rawCertificate[:4], dnscryptCertificateMagic) {
+		return nil, E.New("invalid certificate")
+	}
+	certificate := &dnscryptCertificate{
+		construction: binary.BigEndian.Uint16(rawCertificate[4:6]),
+		serial:       binary.BigEndian.Uint32(rawCertificate[112:116]),
+	}
+	if certificate.construction != DNSCryptXSalsa20Poly1305 && certificate.construction != DNSCryptXChaCha20Poly1305 {
+		return nil, E.New("unsupported certificate construction: ", certificate.construction)
+	}
+	if !ed25519.Verify(t.providerKey, rawCertificate[72:], rawCertificate[8:72]) {
+		return nil, E.New("invalid certificate signature")
+	}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(rawCertificate[116:120])), 0)
+	certificate.notAfter = time.Unix(int64(binary.BigEndian.Uint32(rawCertificate[120:124])), 0)
+	if now.Before(notBefore) || now.After(certificate.notAfter) {
+		return nil, E.New("certificate expired or not yet valid")
+	}
+	certificate.refreshAt = now.Add(dnscryptCertificateLifetime)
+	if certificate.refreshAt.After(certificate.notAfter) {
+		certificate.refreshAt = certificate.notAfter
+	}
+	copy(certificate.clientMagic[:], rawCertificate[104:112])
+	var serverKey [32]byte
+	copy(serverKey[:], rawCertificate[72:104])
+	sharedKey, err := dnscryptSharedKey(certificate.construction, &t.secretKey, &serverKey)
+	if err != nil {
+		return nil, err
+	}
+	certificate.sharedKey = sharedKey
+	return certificate, nil
+}
+
+func (t *DNSCryptTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func dnscryptSharedKey(construction uint16, secretKey *[32]byte, publicKey *[32]byte) ([32]byte, error) {
+	var sharedKey [32]byte
+	if construction == DNSCryptXChaCha20Poly1305 {
+		rawKey, err := curve25519.X25519(secretKey[:], publicKey[:])
+		if err != nil {
+			return sharedKey, err
+		}
+		rawKey, err = chacha20.HChaCha20(rawKey, make([]byte, 16))
+		if err != nil {
+			return sharedKey, err
+		}
+		copy(sharedKey[:], rawKey)
+	} else {
+		box.Precompute(&sharedKey, publicKey, secretKey)
+		if sharedKey == [32]byte{} {
+			return sharedKey, E.New("weak public key")
+		}
+	}
+	return sharedKey, nil
+}
+
+func dnscryptSeal(construction uint16, out []byte, nonce [dnscryptNonceSize]byte, message []byte, sharedKey *[32]byte) []byte {
+	if construction == DNSCryptXChaCha20Poly1305 {
+		return xchachaSeal(out, nonce, message, sharedKey)
+	}
+	return secretbox.Seal(out, message, &nonce, sharedKey)
+}
+
+func dnscryptOpen(certificate *dnscryptCertificate, nonce [dnscryptNonceSize]byte, response []byte) ([]byte, error) {
+	if len(response) < dnscryptResponseHeaderSize+dnscryptTagSize || !bytes.Equal(response[:8], dnscryptResolverMagic) {
+		return nil, E.New("invalid response")
+	}
+	var serverNonce [dnscryptNonceSize]byte
+	copy(serverNonce[:], response[8:dnscryptResponseHeaderSize])
+	if !bytes.Equal(serverNonce[:dnscryptHalfNonceSize], nonce[:dnscryptHalfNonceSize]) {
+		return nil, E.New("unexpected nonce")
+	}
+	var (
+		message []byte
+		loaded  bool
+	)
+	if certificate.construction == DNSCryptXChaCha20Poly1305 {
+		message, loaded = xchachaOpen(nil, serverNonce, response[dnscryptResponseHeaderSize:], &certificate.sharedKey)
+	} else {
+		message, loaded = secretbox.Open(nil, response[dnscryptResponseHeaderSize:], &serverNonce, &certificate.sharedKey)
+	}
+	if !loaded {
+		return nil, E.New("decrypt response")
+	}
+	return dnscryptUnpad(message)
+}
+
+func dnscryptPad(message []byte, paddedLen int) []byte {
+	paddedMessage := make([]byte, paddedLen)
+	copy(paddedMessage, message)
+	paddedMessage[len(message)] = 0x80
+	return paddedMessage
+}
+
+func dnscryptUnpad(message []byte) ([]byte, error) {
+	message = bytes.TrimRight(message, "\x00")
+	if len(message) == 0 || message[len(message)-1] != 0x80 {
+		return nil, E.New("invalid padding")
+	}
+	return message[:len(message)-1], nil
+}
+
+// xchachaSeal is secretbox.Seal with XChaCha20 in place of XSalsa20, as used by DNSCrypt.
+func xchachaSeal(out []byte, nonce [dnscryptNonceSize]byte, message []byte, key *[32]byte) []byte {
+	cipher, polyKey := newXChaChaCipher(nonce, key)
+	ret, sealed := sliceForAppend(out, poly1305.TagSize+len(message))
+	ciphertext := sealed[poly1305.TagSize:]
+	cipher.XORKeyStream(ciphertext, message)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	copy(sealed, tag[:])
+	return ret
+}
+
+func xchachaOpen(out []byte, nonce [dnscryptNonceSize]byte, box []byte, key *[32]byte) ([]byte, bool) {
+	if len(box) < poly1305.TagSize {
+		return nil, false
+	}
+	cipher, polyKey := newXChaChaCipher(nonce, key)
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], box)
+	ciphertext := box[poly1305.TagSize:]
+	if !poly1305.Verify(&tag, ciphertext, &polyKey) {
+		return nil, false
+	}
+	ret, message := sliceForAppend(out, len(ciphertext))
+	cipher.XORKeyStream(message, ciphertext)
+	return ret, true
+}
+
+// newXChaChaCipher returns the keystream positioned after the Poly1305 key taken from the first 32 bytes.
+func newXChaChaCipher(nonce [dnscryptNonceSize]byte, key *[32]byte) (*chacha20.Cipher, [32]byte) {
+	subKey, _ := chacha20.HChaCha20(key[:], nonce[:16])
+	var subNonce [chacha20.NonceSize]byte
+	copy(subNonce[4:], nonce[16:])
+	cipher, _ := chacha20.NewUnauthenticatedCipher(subKey, subNonce[:])
+	var polyKey [32]byte
+	cipher.XORKeyStream(polyKey[:], polyKey[:])
+	return cipher, polyKey
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// unescapeTXT reverses the presentation format escaping applied to TXT strings.
+func unescapeTXT(content string) []byte {
+	result := make([]byte, 0, len(content))
+	for i := 0; i < len(content); i++ {
+		if content[i] != '\\' || i+1 >= len(content) {
+			result = append(result, content[i])
+			continue
+		}
+		i++
+		if i+2 < len(content) && isDigit(content[i]) && isDigit(content[i+1]) && isDigit(content[i+2]) {
+			value, _ := strconv.Atoi(content[i : i+3])
+			result = append(result, byte(value))
+			i += 2
+		} else {
+			result = append(result, content[i])
+		}
+	}
+	return result
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
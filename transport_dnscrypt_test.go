@@ -0,0 +1,275 @@
+package dns
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+type dnscryptTestServer struct {
+	construction uint16
+	providerName string
+	providerKey  ed25519.PrivateKey
+	publicKey    [32]byte
+	secretKey    [32]byte
+	clientMagic  [dnscryptClientMagicSize]byte
+	udpConn      net.PacketConn
+	tcpListener  net.Listener
+}
+
+func newDNSCryptTestServer(t *testing.T, construction uint16) *dnscryptTestServer {
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	require.NoError(t, err)
+	server := &dnscryptTestServer{
+		construction: construction,
+		providerName: "2.dnscrypt-cert.example.com.",
+		providerKey:  providerKey,
+		publicKey:    *publicKey,
+		secretKey:    *secretKey,
+		udpConn:      udpConn,
+		tcpListener:  tcpListener,
+	}
+	copy(server.clientMagic[:], publicKey[:dnscryptClientMagicSize])
+	t.Cleanup(func() {
+		udpConn.Close()
+		tcpListener.Close()
+	})
+	go server.serveUDP()
+	go server.serveTCP()
+	return server
+}
+
+func (s *dnscryptTestServer) stamp() string {
+	rawStamp := []byte{byte(StampProtocolDNSCrypt), 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range [][]byte{
+		[]byte(s.udpConn.LocalAddr().String()),
+		s.providerKey.Public().(ed25519.PublicKey),
+		[]byte(strings.TrimSuffix(s.providerName, ".")),
+	} {
+		rawStamp = append(append(rawStamp, byte(len(field))), field...)
+	}
+	return StampScheme + base64.RawURLEncoding.EncodeToString(rawStamp)
+}
+
+func (s *dnscryptTestServer) certificate() string {
+	rawCertificate := make([]byte, dnscryptCertificateSize)
+	copy(rawCertificate, dnscryptCertificateMagic)
+	binary.BigEndian.PutUint16(rawCertificate[4:], s.construction)
+	copy(rawCertificate[72:], s.publicKey[:])
+	copy(rawCertificate[104:], s.clientMagic[:])
+	binary.BigEndian.PutUint32(rawCertificate[112:], 1)
+	binary.BigEndian.PutUint32(rawCertificate[116:], uint32(time.Now().Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(rawCertificate[120:], uint32(time.Now().Add(time.Hour).Unix()))
+	copy(rawCertificate[8:], ed25519.Sign(s.providerKey, rawCertificate[72:]))
+	var escaped strings.Builder
+	for _, b := range rawCertificate {
+		escaped.WriteString("\\" + strconv.FormatInt(int64(b)+1000, 10)[1:])
+	}
+	return escaped.String()
+}
+
+func (s *dnscryptTestServer) handle(query []byte, network string) []byte {
+	var message dns.Msg
+	if message.Unpack(query) == nil {
+		response := new(dns.Msg)
+		response.SetReply(&message)
+		response.Answer = append(response.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: s.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{s.certificate()},
+		})
+		rawResponse, _ := response.Pack()
+		return rawResponse
+	}
+	if len(query) < dnscryptQueryOverhead || string(query[:dnscryptClientMagicSize]) != string(s.clientMagic[:]) {
+		return nil
+	}
+	var clientKey [32]byte
+	copy(clientKey[:], query[dnscryptClientMagicSize:])
+	var nonce [dnscryptNonceSize]byte
+	copy(nonce[:], query[dnscryptClientMagicSize+32:dnscryptClientMagicSize+32+dnscryptHalfNonceSize])
+	sharedKey, err := dnscryptSharedKey(s.construction, &s.secretKey, &clientKey)
+	if err != nil {
+		return nil
+	}
+	encryptedQuery := query[dnscryptClientMagicSize+32+dnscryptHalfNonceSize:]
+	var (
+		paddedQuery []byte
+		loaded      bool
+	)
+	if s.construction == DNSCryptXChaCha20Poly1305 {
+		paddedQuery, loaded = xchachaOpen(nil, nonce, encryptedQuery, &sharedKey)
+	} else {
+		paddedQuery, loaded = secretbox.Open(nil, encryptedQuery, &nonce, &sharedKey)
+	}
+	if !loaded {
+		return nil
+	}
+	rawQuery, err := dnscryptUnpad(paddedQuery)
+	if err != nil || message.Unpack(rawQuery) != nil {
+		return nil
+	}
+	response := new(dns.Msg)
+	response.SetReply(&message)
+	if message.Question[0].Name == "large." && network == N.NetworkUDP {
+		response.Truncated = true
+	} else {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: message.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(1, 1, 1, 1),
+		})
+	}
+	rawResponse, _ := response.Pack()
+	encryptedResponse := make([]byte, 0, 512)
+	encryptedResponse = append(encryptedResponse, dnscryptResolverMagic...)
+	encryptedResponse = append(encryptedResponse, nonce[:dnscryptHalfNonceSize]...)
+	_, err = rand.Read(nonce[dnscryptHalfNonceSize:])
+	if err != nil {
+		return nil
+	}
+	encryptedResponse = append(encryptedResponse, nonce[dnscryptHalfNonceSize:]...)
+	return dnscryptSeal(s.construction, encryptedResponse, nonce, dnscryptPad(rawResponse, (len(rawResponse)+64)&^63), &sharedKey)
+}
+
+func (s *dnscryptTestServer) serveUDP() {
+	buffer := make([]byte, 65535)
+	for {
+		n, source, err := s.udpConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := s.handle(buffer[:n], N.NetworkUDP); response != nil {
+			s.udpConn.WriteTo(response, source)
+		}
+	}
+}
+
+func (s *dnscryptTestServer) serveTCP() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var queryLen uint16
+			if binary.Read(conn, binary.BigEndian, &queryLen) != nil {
+				return
+			}
+			query := make([]byte, queryLen)
+			if _, readErr := io.ReadFull(conn, query); readErr != nil {
+				return
+			}
+			if response := s.handle(query, N.NetworkTCP); response != nil {
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}
+		}()
+	}
+}
+
+func TestDNSCryptTransport(t *testing.T) {
+	for _, construction := range []uint16{DNSCryptXSalsa20Poly1305, DNSCryptXChaCha20Poly1305} {
+		server := newDNSCryptTestServer(t, construction)
+		t.Run(strconv.Itoa(int(construction)), func(t *testing.T) {
+			transport, err := CreateTransport(TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: server.stamp(),
+				Dialer:  N.SystemDialer,
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			for _, name := range []string{"example.com.", "large."} {
+				message := new(dns.Msg).SetQuestion(name, dns.TypeA)
+				response, exchangeErr := transport.Exchange(context.Background(), message)
+				require.NoError(t, exchangeErr)
+				require.Equal(t, message.Id, response.Id)
+				require.False(t, response.Truncated)
+				require.Len(t, response.Answer, 1)
+			}
+		})
+	}
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	for _, lastByte := range []byte{0x00, 0x80, 0xC2, 0xE0, 0xEF, 0xF0, 0xF4} {
+		message := []byte{0x12, 0x34, lastByte}
+		unpaddedMessage, err := dnscryptUnpad(dnscryptPad(message, 64))
+		require.NoError(t, err)
+		require.Equal(t, message, unpaddedMessage)
+	}
+	_, err := dnscryptUnpad(make([]byte, 64))
+	require.Error(t, err)
+}
+
+// TestDNSCryptKnownAnswer pins the key derivation and box layout to libsodium's
+// crypto_box_curve25519xchacha20poly1305 and crypto_box_curve25519xsalsa20poly1305 easy interfaces.
+func TestDNSCryptKnownAnswer(t *testing.T) {
+	decodeHex := func(content string) []byte {
+		decoded, err := hex.DecodeString(content)
+		require.NoError(t, err)
+		return decoded
+	}
+	var (
+		secretKey [32]byte
+		publicKey [32]byte
+		nonce     [dnscryptNonceSize]byte
+	)
+	for i := range secretKey {
+		secretKey[i] = byte(1 + i)
+	}
+	for i := range nonce {
+		nonce[i] = byte(0x40 + i)
+	}
+	copy(publicKey[:], decodeHex("5869aff450549732cbaaed5e5df9b30a6da31cb0e5742bad5ad4a1a768f1a67b"))
+	message := []byte("DNSCrypt known answer test, long enough to cross the first ChaCha20 block\x80")
+	for _, testCase := range []struct {
+		construction uint16
+		sharedKey    string
+		box          string
+	}{
+		{
+			DNSCryptXChaCha20Poly1305,
+			"477667c7653c9e341690ab1d6c6bbbd9c6178db822a19ef699d3a0239264384d",
+			"e04bf4eb97095e124cb0b85a27c80730924029b7df338f1d4567ab11c764255036d153ca3718ac53b47a4d5a728c08b7d97c5394f03de3f17b27d477d72a45487e6df175b824be3820231af49f68a08748745d70c3a7c02822e9",
+		},
+		{
+			DNSCryptXSalsa20Poly1305,
+			"ec88f6e13b22bf9f04d480e0d8525c08ac7e2f48e212742bcbcafa104a74b08d",
+			"9db993431888633227e987b7c28cbb3c8fb1de07c0f18f51e5c8127078870fa9b025112b08b901ada9c7c62342f789bf0d7b444878733ce52e21c8ab9494b5fbe6510c89514a05130e85ed98f43da8514384780cb5287f368c38",
+		},
+	} {
+		sharedKey, err := dnscryptSharedKey(testCase.construction, &secretKey, &publicKey)
+		require.NoError(t, err)
+		require.Equal(t, testCase.sharedKey, hex.EncodeToString(sharedKey[:]))
+		box := dnscryptSeal(testCase.construction, nil, nonce, message, &sharedKey)
+		require.Equal(t, testCase.box, hex.EncodeToString(box))
+		certificate := &dnscryptCertificate{construction: testCase.construction, sharedKey: sharedKey}
+		response := append(append(append([]byte(nil), dnscryptResolverMagic...), nonce[:]...), decodeHex(testCase.box)...)
+		opened, err := dnscryptOpen(certificate, nonce, response)
+		require.NoError(t, err)
+		require.Equal(t, message[:len(message)-1], opened)
+	}
+}
@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/miekg/dns"
+)
+
+const DefaultFakeIPTTL = 1
+
+// FakeIPOptions configures the fakeip transport. Domains matching Exclude, a list of
+// domain suffixes, go to Fallback, or get NXDOMAIN when it is nil.
+type FakeIPOptions struct {
+	Inet4Range netip.Prefix
+	Inet6Range netip.Prefix
+	Exclude    []string
+	TTL        uint32
+	Storage    FakeIPStorage
+	Fallback   Transport
+}
+
+var _ Transport = (*FakeIPTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"fakeip"}, func(options TransportOptions) (Transport, error) {
+		return NewFakeIPTransport(options)
+	})
+}
+
+type FakeIPTransport struct {
+	name         string
+	ttl          uint32
+	exclude      []string
+	fallback     Transport
+	storage      FakeIPStorage
+	inet4Range   netip.Prefix
+	inet6Range   netip.Prefix
+	access       sync.Mutex
+	inet4Current netip.Addr
+	inet6Current netip.Addr
+}
+
+func NewFakeIPTransport(options TransportOptions) (*FakeIPTransport, error) {
+	fakeIPOptions := options.FakeIP
+	inet4Range := fakeIPOptions.Inet4Range.Masked()
+	inet6Range := fakeIPOptions.Inet6Range.Masked()
+	if !inet4Range.IsValid() && !inet6Range.IsValid() {
+		return nil, E.New("missing fake IP range")
+	}
+	if inet4Range.IsValid() && (!inet4Range.Addr().Is4() || inet4Range.Bits() > 30) {
+		return nil, E.New("invalid inet4 range: ", inet4Range)
+	}
+	if inet6Range.IsValid() && (!inet6Range.Addr().Is6() || inet6Range.Bits() > 126) {
+		return nil, E.New("invalid inet6 range: ", inet6Range)
+	}
+	transport := &FakeIPTransport{
+		name:         options.Name,
+		ttl:          fakeIPOptions.TTL,
+		fallback:     fakeIPOptions.Fallback,
+		storage:      fakeIPOptions.Storage,
+		inet4Range:   inet4Range,
+		inet6Range:   inet6Range,
+		inet4Current: inet4Range.Addr(),
+		inet6Current: inet6Range.Addr(),
+	}
+	if transport.ttl == 0 {
+		transport.ttl = DefaultFakeIPTTL
+	}
+	if transport.storage == nil {
+		transport.storage = NewMemoryFakeIPStorage()
+	}
+	for _, domain := range fakeIPOptions.Exclude {
+		transport.exclude = append(transport.exclude, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	}
+	return transport, nil
+}
+
+func (t *FakeIPTransport) Name() string {
+	return t.name
+}
+
+// Start resumes allocation from the stored metadata, or clears the storage when
+// the configured ranges changed.
+func (t *FakeIPTransport) Start() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	metadata := t.storage.FakeIPMetadata()
+	if metadata != nil && metadata.Inet4Range == t.inet4Range && metadata.Inet6Range == t.inet6Range {
+		if t.inet4Range.Contains(metadata.Inet4Current) {
+			t.inet4Current = metadata.Inet4Current
+		}
+		if t.inet6Range.Contains(metadata.Inet6Current) {
+			t.inet6Current = metadata.Inet6Current
+		}
+		return nil
+	}
+	err := t.storage.FakeIPReset()
+	if err != nil {
+		return E.Cause(err, "reset fake IP storage")
+	}
+	return t.saveMetadata()
+}
+
+func (t *FakeIPTransport) Reset() {
+}
+
+func (t *FakeIPTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.saveMetadata()
+}
+
+func (t *FakeIPTransport) Raw() bool {
+	return true
+}
+
+func (t *FakeIPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 0 {
+		return nil, E.New("bad question size: ", len(message.Question))
+	}
+	question := message.Question[0]
+	domain := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+	if t.excluded(domain) {
+		if t.fallback != nil {
+			return t.fallback.Exchange(ctx, message)
+		}
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeNameError)
+		return response, nil
+	}
+	response := new(dns.Msg)
+	response.SetReply(message)
+	response.RecursionAvailable = true
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: t.ttl}
+	switch question.Qtype {
+	case dns.TypeA:
+		if t.inet4Range.IsValid() {
+			address, err := t.allocate(domain, false)
+			if err != nil {
+				return nil, err
+			}
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: address.AsSlice()})
+		}
+	case dns.TypeAAAA:
+		if t.inet6Range.IsValid() {
+			address, err := t.allocate(domain, true)
+			if err != nil {
+				return nil, err
+			}
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: address.AsSlice()})
+		}
+	case dns.TypeHTTPS:
+		// hints carry the same fake addresses as A and AAAA, Client strips the family DomainStrategy rejects
+		https := &dns.HTTPS{SVCB: dns.SVCB{Hdr: header, Priority: 1, Target: "."}}
+		if t.inet4Range.IsValid() {
+			address, err := t.allocate(domain, false)
+			if err != nil {
+				return nil, err
+			}
+			https.Value = append(https.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{address.AsSlice()}})
+		}
+		if t.inet6Range.IsValid() {
+			address, err := t.allocate(domain, true)
+			if err != nil {
+				return nil, err
+			}
+			https.Value = append(https.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{address.AsSlice()}})
+		}
+		response.Answer = append(response.Answer, https)
+	}
+	return response, nil
+}
+
+func (t *FakeIPTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+// LookupDomain returns the domain a fake address was handed out for.
+func (t *FakeIPTransport) LookupDomain(address netip.Addr) (string, bool) {
+	address = address.Unmap()
+	if !t.inet4Range.Contains(address) && !t.inet6Range.Contains(address) {
+		return "", false
+	}
+	return t.storage.FakeIPLoad(address)
+}
+
+func (t *FakeIPTransport) excluded(domain string) bool {
+	for _, suffix := range t.exclude {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate returns the stable address of domain, handing out the next address of the
+// range when there is none. Exhausted ranges wrap around and reuse the oldest addresses.
+func (t *FakeIPTransport) allocate(domain string, isIPv6 bool) (netip.Addr, error) {
+	prefix, current := t.inet4Range, &t.inet4Current
+	if isIPv6 {
+		prefix, current = t.inet6Range, &t.inet6Current
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if address, loaded := t.storage.FakeIPLoadDomain(domain, isIPv6); loaded && prefix.Contains(address) {
+		return address, nil
+	}
+	address := current.Next()
+	if !prefix.Contains(address.Next()) {
+		// skip the network and broadcast addresses
+		address = prefix.Addr().Next()
+	}
+	// the pointer is saved before the mapping, so that a crash in between skips an address instead of reusing it
+	*current = address
+	err := t.saveMetadata()
+	if err != nil {
+		return netip.Addr{}, E.Cause(err, "save fake IP metadata")
+	}
+	err = t.storage.FakeIPStore(address, domain)
+	if err != nil {
+		return netip.Addr{}, E.Cause(err, "store fake IP")
+	}
+	return address, nil
+}
+
+func (t *FakeIPTransport) saveMetadata() error {
+	return t.storage.FakeIPSaveMetadata(&FakeIPMetadata{
+		Inet4Range:   t.inet4Range,
+		Inet6Range:   t.inet6Range,
+		Inet4Current: t.inet4Current,
+		Inet6Current: t.inet6Current,
+	})
+}
@@ -0,0 +1,74 @@
+package dns_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeIPTransport(t *testing.T) {
+	storage := dns.NewMemoryFakeIPStorage()
+	newTransport := func() *dns.FakeIPTransport {
+		transport, err := dns.CreateTransport(dns.TransportOptions{
+			Context: context.Background(),
+			Logger:  logger.NOP(),
+			Address: "fakeip",
+			FakeIP: dns.FakeIPOptions{
+				Inet4Range: netip.MustParsePrefix("198.18.0.0/30"),
+				Inet6Range: netip.MustParsePrefix("fc00::/18"),
+				Exclude:    []string{"lan"},
+				Storage:    storage,
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, transport.Start())
+		return transport.(*dns.FakeIPTransport)
+	}
+	transport := newTransport()
+	client := dns.NewClient(dns.ClientOptions{DisableCache: true})
+
+	addresses, err := client.Lookup(context.Background(), transport, "example.com", dns.DomainStrategyAsIS)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("198.18.0.1"), netip.MustParseAddr("fc00::1")}, addresses)
+	addresses, err = client.Lookup(context.Background(), transport, "Example.com.", dns.DomainStrategyUseIPv4)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("198.18.0.1")}, addresses)
+	domain, loaded := transport.LookupDomain(netip.MustParseAddr("fc00::1"))
+	require.True(t, loaded)
+	require.Equal(t, "example.com", domain)
+
+	response, err := client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion("example.org.", mDNS.TypeHTTPS), dns.DomainStrategyUseIPv6)
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(dns.DefaultFakeIPTTL), response.Answer[0].Header().Ttl)
+	addresses, err = dns.MessageToAddresses(response)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("fc00::2")}, addresses)
+
+	response, err = client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion("printer.lan.", mDNS.TypeA), dns.DomainStrategyAsIS)
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+
+	// the /30 range holds two usable addresses, the third domain takes over the first one
+	addresses, err = client.Lookup(context.Background(), transport, "example.net", dns.DomainStrategyUseIPv4)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("198.18.0.1")}, addresses)
+	domain, _ = transport.LookupDomain(netip.MustParseAddr("198.18.0.1"))
+	require.Equal(t, "example.net", domain)
+
+	// no Close, as if the process was killed
+	transport = newTransport()
+	defer transport.Close()
+	domain, loaded = transport.LookupDomain(netip.MustParseAddr("198.18.0.2"))
+	require.True(t, loaded)
+	require.Equal(t, "example.org", domain)
+	addresses, err = client.Lookup(context.Background(), transport, "example.com", dns.DomainStrategyUseIPv4)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("198.18.0.2")}, addresses)
+}
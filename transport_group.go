@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	GroupModeFailover   = "failover"
+	GroupModeRoundRobin = "round_robin"
+	GroupModeRandom     = "random"
+	GroupModeRace       = "race"
+)
+
+// GroupOptions lists the members of a group transport, which are started and closed by their owner.
+type GroupOptions struct {
+	Transports []Transport
+}
+
+var _ Transport = (*GroupTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"group"}, func(options TransportOptions) (Transport, error) {
+		return NewGroupTransport(options)
+	})
+}
+
+// GroupTransport exchanges through its members as one transport. Members failing with an
+// error or SERVFAIL are skipped in favor of the next one, racing members are queried at once.
+type GroupTransport struct {
+	name       string
+	mode       string
+	transports []Transport
+	raw        bool
+	index      atomic.Uint32
+}
+
+type groupResult[T any] struct {
+	response      T
+	transportName string
+	err           error
+}
+
+func NewGroupTransport(options TransportOptions) (*GroupTransport, error) {
+	mode := GroupModeFailover
+	if options.Address != "group" {
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		switch serverURL.Host {
+		case GroupModeFailover, GroupModeRoundRobin, GroupModeRandom, GroupModeRace:
+			mode = serverURL.Host
+		default:
+			return nil, E.New("unknown group mode: ", serverURL.Host)
+		}
+	}
+	transports := options.Group.Transports
+	if len(transports) == 0 {
+		return nil, E.New("missing group transports")
+	}
+	raw := transports[0].Raw()
+	for _, transport := range transports[1:] {
+		if transport.Raw() != raw {
+			return nil, E.New("group transports must all support raw queries or none of them")
+		}
+	}
+	return &GroupTransport{
+		name:       options.Name,
+		mode:       mode,
+		transports: transports,
+		raw:        raw,
+	}, nil
+}
+
+func (t *GroupTransport) Name() string {
+	return t.name
+}
+
+func (t *GroupTransport) Start() error {
+	return nil
+}
+
+func (t *GroupTransport) Reset() {
+}
+
+func (t *GroupTransport) Close() error {
+	return nil
+}
+
+func (t *GroupTransport) Raw() bool {
+	return t.raw
+}
+
+func (t *GroupTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	return groupExchange(ctx, t, func(ctx context.Context, transport Transport) (*dns.Msg, error) {
+		return transport.Exchange(ctx, message)
+	}, func(response *dns.Msg) bool {
+		return response.Rcode == dns.RcodeServerFailure
+	})
+}
+
+func (t *GroupTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return groupExchange(ctx, t, func(ctx context.Context, transport Transport) ([]netip.Addr, error) {
+		return transport.Lookup(ctx, domain, strategy)
+	}, func(response []netip.Addr) bool {
+		return false
+	})
+}
+
+// members returns the members in the order of the group mode, leaving out those
+// the response cache of the Client rejected for the current question.
+func (t *GroupTransport) members(ctx context.Context) []Transport {
+	var start int
+	switch t.mode {
+	case GroupModeRoundRobin:
+		start = int((t.index.Add(1) - 1) % uint32(len(t.transports)))
+	case GroupModeRandom:
+		start = rand.Intn(len(t.transports))
+	}
+	rejected, rejectedLoaded := rdrcRejectedFromContext(ctx)
+	members := make([]Transport, 0, len(t.transports))
+	for index := range t.transports {
+		member := t.transports[(start+index)%len(t.transports)]
+		if rejectedLoaded && rejected(member.Name()) {
+			continue
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+func groupExchange[T any](ctx context.Context, t *GroupTransport, exchange func(ctx context.Context, transport Transport) (T, error), failed func(response T) bool) (T, error) {
+	var (
+		lastResult *groupResult[T]
+		errors     []error
+	)
+	members := t.members(ctx)
+	if len(members) == 0 {
+		var response T
+		return response, ErrResponseRejectedCached
+	}
+	handle := func(result groupResult[T]) bool {
+		if result.err != nil {
+			errors = append(errors, result.err)
+			return false
+		}
+		lastResult = &result
+		return !failed(result.response)
+	}
+	if t.mode == GroupModeRace {
+		raceCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan groupResult[T], len(members))
+		for _, member := range members {
+			go func(member Transport) {
+				results <- groupExchangeMember(raceCtx, member, exchange)
+			}(member)
+		}
+		for range members {
+			if handle(<-results) {
+				break
+			}
+		}
+	} else {
+		for _, member := range members {
+			if handle(groupExchangeMember(ctx, member, exchange)) || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	if lastResult == nil {
+		var response T
+		return response, E.Errors(errors...)
+	}
+	setResponseTransport(ctx, lastResult.transportName)
+	return lastResult.response, nil
+}
+
+func groupExchangeMember[T any](ctx context.Context, member Transport, exchange func(ctx context.Context, transport Transport) (T, error)) groupResult[T] {
+	if transportName, loaded := transportNameFromContext(ctx); loaded && transportName == member.Name() {
+		return groupResult[T]{err: E.New("DNS query loopback in transport[", transportName, "]")}
+	}
+	ctx, responseTransport := contextWithResponseTransport(contextWithTransportName(ctx, member.Name()))
+	response, err := exchange(ctx, member)
+	if err != nil {
+		return groupResult[T]{err: E.Cause(err, "transport[", member.Name(), "]")}
+	}
+	return groupResult[T]{response: response, transportName: responseTransportName(member, *responseTransport)}
+}
@@ -0,0 +1,96 @@
+package dns_test
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testRDRCStore struct {
+	access   sync.Mutex
+	rejected map[string]bool
+}
+
+func (s *testRDRCStore) LoadRDRC(transportName string, qName string, qType uint16) bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.rejected[transportName+" "+qName+" "+mDNS.TypeToString[qType]]
+}
+
+func (s *testRDRCStore) SaveRDRC(transportName string, qName string, qType uint16) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.rejected[transportName+" "+qName+" "+mDNS.TypeToString[qType]] = true
+	return nil
+}
+
+func (s *testRDRCStore) SaveRDRCAsync(transportName string, qName string, qType uint16, logger logger.Logger) {
+	s.SaveRDRC(transportName, qName, qType)
+}
+
+func TestGroupTransport(t *testing.T) {
+	newTransport := func(name string, address string, options dns.TransportOptions) dns.Transport {
+		options.Context = context.Background()
+		options.Logger = logger.NOP()
+		options.Name = name
+		options.Address = address
+		transport, err := dns.CreateTransport(options)
+		require.NoError(t, err)
+		return transport
+	}
+	newAddressTransport := func(name string, address string) dns.Transport {
+		return newTransport(name, "rcode://address", dns.TransportOptions{
+			Block: dns.BlockOptions{Addresses: []netip.Addr{netip.MustParseAddr(address)}},
+		})
+	}
+	serverFailure := newTransport("server-failure", "rcode://server_failure", dns.TransportOptions{})
+	first := newAddressTransport("first", "192.0.2.1")
+	second := newAddressTransport("second", "192.0.2.2")
+	newGroup := func(address string, members ...dns.Transport) dns.Transport {
+		return newTransport("group", address, dns.TransportOptions{Group: dns.GroupOptions{Transports: members}})
+	}
+	client := dns.NewClient(dns.ClientOptions{DisableCache: true})
+	lookup := func(transport dns.Transport) string {
+		addresses, err := client.Lookup(context.Background(), transport, "example.com", dns.DomainStrategyUseIPv4)
+		require.NoError(t, err)
+		require.Len(t, addresses, 1)
+		return addresses[0].String()
+	}
+
+	require.Equal(t, "192.0.2.1", lookup(newGroup("group", serverFailure, first, second)))
+	require.Equal(t, "192.0.2.2", lookup(newGroup("group://race", serverFailure, second)))
+	roundRobin := newGroup("group://round_robin", first, second)
+	require.Equal(t, "192.0.2.1", lookup(roundRobin))
+	require.Equal(t, "192.0.2.2", lookup(roundRobin))
+	require.Equal(t, "192.0.2.1", lookup(roundRobin))
+
+	response, err := client.Exchange(context.Background(), newGroup("group", serverFailure), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA), dns.DomainStrategyAsIS)
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+
+	store := &testRDRCStore{rejected: make(map[string]bool)}
+	client = dns.NewClient(dns.ClientOptions{
+		DisableCache: true,
+		RDRC: func() dns.RDRCStore {
+			return store
+		},
+	})
+	client.Start()
+	failover := newGroup("group", first, second)
+	checker := func(addresses []netip.Addr) bool {
+		return addresses[0] != netip.MustParseAddr("192.0.2.1")
+	}
+	_, err = client.LookupWithResponseCheck(context.Background(), failover, "example.com", dns.DomainStrategyUseIPv4, checker)
+	require.ErrorIs(t, err, dns.ErrResponseRejected)
+	require.True(t, store.LoadRDRC("first", "example.com.", mDNS.TypeA))
+	addresses, err := client.LookupWithResponseCheck(context.Background(), failover, "example.com", dns.DomainStrategyUseIPv4, checker)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, addresses)
+}
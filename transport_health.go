@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultHealthFailureThreshold = 3
+	DefaultHealthProbeInterval    = 10 * time.Second
+)
+
+var ErrCircuitOpen = E.New("circuit open")
+
+// HealthOptions enables health tracking for a transport. After FailureThreshold consecutive
+// failures queries fail fast with ErrCircuitOpen, until the probe query succeeds again.
+// Probe must carry exactly one question, non-raw transports only look up its name.
+type HealthOptions struct {
+	Enabled          bool
+	FailureThreshold int
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	Probe            *dns.Msg
+}
+
+type CircuitState uint8
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+type TransportHealth struct {
+	State               CircuitState
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures int
+	RTT                 time.Duration
+	LastError           error
+	LastChecked         time.Time
+}
+
+func (h TransportHealth) SuccessRate() float64 {
+	if h.Successes+h.Failures == 0 {
+		return 1
+	}
+	return float64(h.Successes) / float64(h.Successes+h.Failures)
+}
+
+var _ Transport = (*HealthTransport)(nil)
+
+type HealthTransport struct {
+	Transport
+	ctx              context.Context
+	cancel           context.CancelFunc
+	logger           logger.ContextLogger
+	failureThreshold int
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	probe            *dns.Msg
+	access           sync.Mutex
+	health           TransportHealth
+	probing          bool
+}
+
+func NewHealthTransport(ctx context.Context, logger logger.ContextLogger, transport Transport, options HealthOptions) (*HealthTransport, error) {
+	if options.Probe != nil && len(options.Probe.Question) != 1 {
+		return nil, E.New("health probe must have exactly one question")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	healthTransport := &HealthTransport{
+		Transport:        transport,
+		ctx:              ctx,
+		cancel:           cancel,
+		logger:           logger,
+		failureThreshold: options.FailureThreshold,
+		probeInterval:    options.ProbeInterval,
+		probeTimeout:     options.ProbeTimeout,
+		probe:            options.Probe,
+	}
+	if healthTransport.failureThreshold == 0 {
+		healthTransport.failureThreshold = DefaultHealthFailureThreshold
+	}
+	if healthTransport.probeInterval == 0 {
+		healthTransport.probeInterval = DefaultHealthProbeInterval
+	}
+	if healthTransport.probeTimeout == 0 {
+		healthTransport.probeTimeout = DefaultTimeout
+	}
+	if healthTransport.probe == nil {
+		healthTransport.probe = new(dns.Msg).SetQuestion(".", dns.TypeNS)
+	}
+	return healthTransport, nil
+}
+
+func (t *HealthTransport) Reset() {
+	t.Transport.Reset()
+	t.access.Lock()
+	// the network changed, give the upstream another chance
+	t.health.State = CircuitClosed
+	t.health.ConsecutiveFailures = 0
+	t.access.Unlock()
+}
+
+func (t *HealthTransport) Close() error {
+	t.cancel()
+	return t.Transport.Close()
+}
+
+func (t *HealthTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if t.Health().State == CircuitOpen {
+		return nil, ErrCircuitOpen
+	}
+	start := time.Now()
+	response, err := t.Transport.Exchange(ctx, message)
+	t.record(ctx, time.Since(start), err)
+	return response, err
+}
+
+func (t *HealthTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	if t.Health().State == CircuitOpen {
+		return nil, ErrCircuitOpen
+	}
+	start := time.Now()
+	addresses, err := t.Transport.Lookup(ctx, domain, strategy)
+	t.record(ctx, time.Since(start), err)
+	return addresses, err
+}
+
+func (t *HealthTransport) Health() TransportHealth {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.health
+}
+
+func (t *HealthTransport) record(ctx context.Context, rtt time.Duration, err error) {
+	if err != nil && ctx.Err() == context.Canceled {
+		// abandoned by the caller, such as a lost race in a group
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.health.LastChecked = time.Now()
+	if err != nil {
+		t.health.Failures++
+		t.health.ConsecutiveFailures++
+		t.health.LastError = err
+		if t.health.State == CircuitClosed && t.health.ConsecutiveFailures >= t.failureThreshold {
+			t.health.State = CircuitOpen
+			t.logger.Warn("transport[", t.Name(), "] unavailable: ", err)
+			if !t.probing {
+				t.probing = true
+				go t.loopProbe()
+			}
+		}
+		return
+	}
+	t.health.Successes++
+	t.health.ConsecutiveFailures = 0
+	t.health.LastError = nil
+	if t.health.RTT == 0 {
+		t.health.RTT = rtt
+	} else {
+		// smoothed as the TCP SRTT in RFC 6298
+		t.health.RTT += (rtt - t.health.RTT) / 8
+	}
+	if t.health.State == CircuitOpen {
+		t.health.State = CircuitClosed
+		t.logger.Info("transport[", t.Name(), "] recovered")
+	}
+}
+
+func (t *HealthTransport) loopProbe() {
+	ticker := time.NewTicker(t.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.access.Lock()
+		if t.health.State == CircuitClosed {
+			t.probing = false
+			t.access.Unlock()
+			return
+		}
+		t.access.Unlock()
+		ctx, cancel := context.WithTimeout(t.ctx, t.probeTimeout)
+		start := time.Now()
+		var err error
+		if t.Transport.Raw() {
+			_, err = t.Transport.Exchange(ctx, t.probe.Copy())
+		} else {
+			_, err = t.Transport.Lookup(ctx, t.probe.Question[0].Name, DomainStrategyAsIS)
+			if isNegativeAnswer(err) {
+				// the probe name need not have addresses, any answer proves the upstream reachable
+				err = nil
+			}
+		}
+		cancel()
+		if t.ctx.Err() != nil {
+			return
+		}
+		t.record(t.ctx, time.Since(start), err)
+	}
+}
+
+func isNegativeAnswer(err error) bool {
+	if rcodeErr, isRCodeErr := E.Cast[RCodeError](err); isRCodeErr {
+		return rcodeErr == RCodeSuccess || rcodeErr == RCodeNameError
+	}
+	dnsErr, isDNSErr := E.Cast[*net.DNSError](err)
+	return isDNSErr && dnsErr.IsNotFound
+}
@@ -0,0 +1,87 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTransport(t *testing.T) {
+	var failing atomic.Bool
+	upstream := newTestTransport(func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		if failing.Load() {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return new(mDNS.Msg).SetReply(message), nil
+	})
+	transport, err := dns.NewHealthTransport(context.Background(), logger.NOP(), upstream, dns.HealthOptions{
+		FailureThreshold: 2,
+		ProbeInterval:    50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	exchange := func() error {
+		_, err := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+		return err
+	}
+
+	require.NoError(t, exchange())
+	failing.Store(true)
+	require.ErrorIs(t, exchange(), os.ErrDeadlineExceeded)
+	require.Equal(t, dns.CircuitClosed, transport.Health().State)
+	require.Error(t, exchange())
+	health := transport.Health()
+	require.Equal(t, dns.CircuitOpen, health.State)
+	require.Equal(t, 2, health.ConsecutiveFailures)
+	require.InDelta(t, 1.0/3, health.SuccessRate(), 0.01)
+
+	exchanges := upstream.queries.Load()
+	require.ErrorIs(t, exchange(), dns.ErrCircuitOpen)
+	require.Equal(t, exchanges, upstream.queries.Load())
+
+	failing.Store(false)
+	require.Eventually(t, func() bool {
+		return transport.Health().State == dns.CircuitClosed
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, exchange())
+}
+
+func TestHealthTransportLookup(t *testing.T) {
+	var failing atomic.Bool
+	upstream := &testTransport{lookup: func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		if failing.Load() {
+			return nil, os.ErrDeadlineExceeded
+		}
+		if domain != "example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+	}}
+	_, err := dns.NewHealthTransport(context.Background(), logger.NOP(), upstream, dns.HealthOptions{Probe: new(mDNS.Msg)})
+	require.Error(t, err)
+	transport, err := dns.NewHealthTransport(context.Background(), logger.NOP(), upstream, dns.HealthOptions{
+		FailureThreshold: 1,
+		ProbeInterval:    50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	failing.Store(true)
+	_, err = transport.Lookup(context.Background(), "example.com", dns.DomainStrategyAsIS)
+	require.Error(t, err)
+	require.Equal(t, dns.CircuitOpen, transport.Health().State)
+	failing.Store(false)
+	// the default probe name has no addresses, the upstream answering it is enough
+	require.Eventually(t, func() bool {
+		return transport.Health().State == dns.CircuitClosed
+	}, time.Second, 10*time.Millisecond)
+}
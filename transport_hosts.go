@@ -0,0 +1,315 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultHostsPath       = "/etc/hosts"
+	DefaultHostsTTL        = 10
+	hostsFileCheckInterval = 5 * time.Second
+)
+
+// HostsOptions configures the hosts transport. Entries are served alongside the files, which are
+// checked for changes at most every five seconds. Names missing from both go to Fallback, or get
+// NXDOMAIN when it is nil.
+type HostsOptions struct {
+	Path     []string
+	Entries  map[string][]netip.Addr
+	TTL      uint32
+	Fallback Transport
+}
+
+var _ Transport = (*HostsTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"hosts"}, func(options TransportOptions) (Transport, error) {
+		return NewHostsTransport(options)
+	})
+}
+
+type HostsTransport struct {
+	name      string
+	logger    logger.ContextLogger
+	ttl       uint32
+	entries   *hostsTable
+	fallback  Transport
+	access    sync.Mutex
+	files     []hostsFile
+	table     *hostsTable
+	checkedAt time.Time
+}
+
+type hostsFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+type hostsTable struct {
+	addresses map[string][]netip.Addr
+	names     map[netip.Addr][]string
+}
+
+func NewHostsTransport(options TransportOptions) (*HostsTransport, error) {
+	paths := options.Hosts.Path
+	if options.Address != "hosts" {
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		if serverURL.Path != "" {
+			paths = append([]string{serverURL.Path}, paths...)
+		}
+	}
+	if len(paths) == 0 && len(options.Hosts.Entries) == 0 {
+		paths = []string{DefaultHostsPath}
+	}
+	entries := newHostsTable()
+	for name, addresses := range options.Hosts.Entries {
+		for _, address := range addresses {
+			entries.add(name, address)
+		}
+	}
+	transport := &HostsTransport{
+		name:     options.Name,
+		logger:   options.Logger,
+		ttl:      options.Hosts.TTL,
+		entries:  entries,
+		fallback: options.Hosts.Fallback,
+		table:    entries,
+	}
+	if transport.ttl == 0 {
+		transport.ttl = DefaultHostsTTL
+	}
+	for _, path := range paths {
+		transport.files = append(transport.files, hostsFile{path: path})
+	}
+	return transport, nil
+}
+
+func (t *HostsTransport) Name() string {
+	return t.name
+}
+
+func (t *HostsTransport) Start() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.reload(true)
+}
+
+func (t *HostsTransport) Reset() {
+}
+
+func (t *HostsTransport) Close() error {
+	return nil
+}
+
+func (t *HostsTransport) Raw() bool {
+	return true
+}
+
+func (t *HostsTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 0 {
+		return nil, E.New("bad question size: ", len(message.Question))
+	}
+	t.access.Lock()
+	err := t.reload(false)
+	table := t.table
+	t.access.Unlock()
+	if err != nil {
+		// the last table that loaded keeps being served
+		t.logger.WarnContext(ctx, E.Cause(err, "reload hosts"))
+	}
+	question := message.Question[0]
+	name := strings.ToLower(question.Name)
+	response := new(dns.Msg)
+	response.SetReply(message)
+	response.Authoritative = true
+	response.RecursionAvailable = true
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: t.ttl}
+	var loaded bool
+	switch question.Qtype {
+	case dns.TypePTR:
+		var names []string
+		if address, isReverse := parseReverseName(name); isReverse {
+			names, loaded = table.names[address]
+		}
+		for _, ptrName := range names {
+			response.Answer = append(response.Answer, &dns.PTR{Hdr: header, Ptr: ptrName})
+		}
+	default:
+		var addresses []netip.Addr
+		addresses, loaded = table.addresses[name]
+		for _, address := range addresses {
+			if question.Qtype == dns.TypeA && address.Is4() {
+				response.Answer = append(response.Answer, &dns.A{Hdr: header, A: address.AsSlice()})
+			} else if question.Qtype == dns.TypeAAAA && address.Is6() {
+				response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: address.AsSlice()})
+			}
+		}
+	}
+	if !loaded {
+		if t.fallback != nil {
+			return t.fallback.Exchange(ctx, message)
+		}
+		response.Rcode = dns.RcodeNameError
+	}
+	return response, nil
+}
+
+func (t *HostsTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+// reload rebuilds the table when the modification time or size of any file changed,
+// the caller must hold access. File states are only recorded once the table loaded, so that a
+// failed reload is retried at the next check.
+func (t *HostsTransport) reload(force bool) error {
+	now := time.Now()
+	if !force && now.Sub(t.checkedAt) < hostsFileCheckInterval {
+		return nil
+	}
+	t.checkedAt = now
+	changed := force
+	files := make([]hostsFile, 0, len(t.files))
+	for _, file := range t.files {
+		var (
+			modTime time.Time
+			size    int64
+		)
+		fileInfo, err := os.Stat(file.path)
+		if err == nil {
+			modTime = fileInfo.ModTime()
+			size = fileInfo.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if !modTime.Equal(file.modTime) || size != file.size {
+			file.modTime = modTime
+			file.size = size
+			changed = true
+		}
+		files = append(files, file)
+	}
+	if !changed {
+		return nil
+	}
+	table := newHostsTable()
+	table.merge(t.entries)
+	for _, file := range files {
+		if file.modTime.IsZero() {
+			continue
+		}
+		content, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+		err = table.parse(content)
+		content.Close()
+		if err != nil {
+			return E.Cause(err, "parse ", file.path)
+		}
+	}
+	t.files = files
+	t.table = table
+	return nil
+}
+
+func newHostsTable() *hostsTable {
+	return &hostsTable{
+		addresses: make(map[string][]netip.Addr),
+		names:     make(map[netip.Addr][]string),
+	}
+}
+
+func (h *hostsTable) add(name string, address netip.Addr) {
+	name = dns.Fqdn(strings.ToLower(name))
+	address = address.Unmap().WithZone("")
+	for _, existing := range h.addresses[name] {
+		if existing == address {
+			return
+		}
+	}
+	h.addresses[name] = append(h.addresses[name], address)
+	h.names[address] = append(h.names[address], name)
+}
+
+func (h *hostsTable) merge(other *hostsTable) {
+	for name, addresses := range other.addresses {
+		for _, address := range addresses {
+			h.add(name, address)
+		}
+	}
+}
+
+func (h *hostsTable) parse(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		address, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			h.add(name, address)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseReverseName decodes in-addr.arpa and ip6.arpa names.
+func parseReverseName(name string) (netip.Addr, bool) {
+	if reverseName, isIPv4 := strings.CutSuffix(name, ".in-addr.arpa."); isIPv4 {
+		labels := strings.Split(reverseName, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var address [4]byte
+		for index, label := range labels {
+			value, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			address[3-index] = byte(value)
+		}
+		return netip.AddrFrom4(address), true
+	} else if reverseName, isIPv6 := strings.CutSuffix(name, ".ip6.arpa."); isIPv6 {
+		labels := strings.Split(reverseName, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var address [16]byte
+		for index, label := range labels {
+			value, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			nibble := 31 - index
+			address[nibble/2] |= byte(value) << (4 * (1 - nibble%2))
+		}
+		return netip.AddrFrom16(address), true
+	}
+	return netip.Addr{}, false
+}
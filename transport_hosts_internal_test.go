@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsTransportReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1 example.test\n"), 0o644))
+	transport, err := NewHostsTransport(TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "hosts://" + path,
+	})
+	require.NoError(t, err)
+	require.NoError(t, transport.Start())
+	exchange := func(name string) int {
+		response, err := transport.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.NoError(t, err)
+		return response.Rcode
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.2 reloaded.test\n"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	// the file is not checked again within the interval
+	require.Equal(t, dns.RcodeSuccess, exchange("example.test."))
+	transport.checkedAt = time.Time{}
+	require.Equal(t, dns.RcodeNameError, exchange("example.test."))
+	require.Equal(t, dns.RcodeSuccess, exchange("reloaded.test."))
+
+	// a file that can not be read keeps the last table, and is retried at the next check
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Mkdir(path, 0o755))
+	transport.checkedAt = time.Time{}
+	require.Equal(t, dns.RcodeSuccess, exchange("reloaded.test."))
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1 example.test\n"), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	transport.checkedAt = time.Time{}
+	require.Equal(t, dns.RcodeSuccess, exchange("example.test."))
+	require.Equal(t, dns.RcodeNameError, exchange("reloaded.test."))
+}
@@ -0,0 +1,81 @@
+package dns_test
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("127.0.0.1 localhost\n::1 localhost ip6-localhost # loopback\n192.0.2.1 Example.COM www.example.com\n"), 0o644))
+	fallback, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "rcode://refused",
+	})
+	require.NoError(t, err)
+	for _, testCase := range []struct {
+		name     string
+		fallback dns.Transport
+		rcode    int
+	}{
+		{"nxdomain", nil, mDNS.RcodeNameError},
+		{"fallback", fallback, mDNS.RcodeRefused},
+	} {
+		missFallback := testCase.fallback
+		missRcode := testCase.rcode
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: "hosts://" + path,
+				Hosts: dns.HostsOptions{
+					Entries:  map[string][]netip.Addr{"inline.test": {netip.MustParseAddr("192.0.2.2")}},
+					Fallback: missFallback,
+				},
+			})
+			require.NoError(t, err)
+			require.NoError(t, transport.Start())
+			defer transport.Close()
+			client := dns.NewClient(dns.ClientOptions{DisableCache: true})
+
+			addresses, err := client.Lookup(context.Background(), transport, "localhost", dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.ElementsMatch(t, []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}, addresses)
+			addresses, err = client.Lookup(context.Background(), transport, "localhost", dns.DomainStrategyUseIPv6)
+			require.NoError(t, err)
+			require.Equal(t, []netip.Addr{netip.MustParseAddr("::1")}, addresses)
+			addresses, err = client.Lookup(context.Background(), transport, "inline.test", dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, addresses)
+
+			response, err := client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion("ip6-localhost.", mDNS.TypeA), dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+			require.Empty(t, response.Answer)
+
+			response, err = client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion("1.2.0.192.in-addr.arpa.", mDNS.TypePTR), dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.Len(t, response.Answer, 2)
+			require.Equal(t, "example.com.", response.Answer[0].(*mDNS.PTR).Ptr)
+			reverseName, err := mDNS.ReverseAddr("::1")
+			require.NoError(t, err)
+			response, err = client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion(reverseName, mDNS.TypePTR), dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.Len(t, response.Answer, 2)
+
+			response, err = client.Exchange(context.Background(), transport, new(mDNS.Msg).SetQuestion("missing.test.", mDNS.TypeA), dns.DomainStrategyAsIS)
+			require.NoError(t, err)
+			require.Equal(t, missRcode, response.Rcode)
+		})
+	}
+}
@@ -3,12 +3,15 @@ package dns
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -19,11 +22,30 @@ import (
 
 const MimeType = "application/dns-message"
 
+type HTTPMethod uint8
+
+const (
+	HTTPMethodPOST HTTPMethod = iota
+	HTTPMethodGET
+	HTTPMethodAuto
+)
+
+// maxHTTPGetURLLength is the longest URL HTTPMethodAuto sends with GET before falling back to POST.
+const maxHTTPGetURLLength = 2048
+
+// HTTPOptions configures DoH requests. Address may be an RFC 6570 URI template such as
+// https://dns.example/dns-query{?dns}, and user info in it is sent as basic authentication.
+type HTTPOptions struct {
+	Method  HTTPMethod
+	Headers http.Header
+}
+
 var _ Transport = (*HTTPSTransport)(nil)
 
 type HTTPSTransport struct {
 	name        string
 	destination string
+	options     HTTPOptions
 	transport   *http.Transport
 }
 
@@ -34,17 +56,20 @@ func init() {
 }
 
 func NewHTTPSTransport(options TransportOptions) *HTTPSTransport {
+	var serverName string
+	if serverURL, _ := url.Parse(options.Address); serverURL != nil {
+		serverName = serverURL.Hostname()
+	}
 	return &HTTPSTransport{
 		name:        options.Name,
 		destination: options.Address,
+		options:     options.HTTP,
 		transport: &http.Transport{
 			ForceAttemptHTTP2: true,
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				return options.Dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
 			},
-			TLSClientConfig: &tls.Config{
-				NextProtos: []string{"dns"},
-			},
+			TLSClientConfig: NewTLSConfig(options, serverName, []string{"dns"}),
 		},
 	}
 }
@@ -75,38 +100,50 @@ func (t *HTTPSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.M
 	exMessage := *message
 	exMessage.Id = 0
 	exMessage.Compress = true
-	requestBuffer := buf.NewSize(1 + message.Len())
-	rawMessage, err := exMessage.PackBuffer(requestBuffer.FreeBytes())
+	paddedMessage := PadMessage(&exMessage)
+	requestBuffer := buf.NewSize(1 + paddedMessage.Len())
+	rawMessage, err := paddedMessage.PackBuffer(requestBuffer.FreeBytes())
 	if err != nil {
 		requestBuffer.Release()
 		return nil, err
 	}
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.destination, bytes.NewReader(rawMessage))
+	request, err := NewHTTPRequest(ctx, t.options, t.destination, rawMessage)
 	if err != nil {
 		requestBuffer.Release()
 		return nil, err
 	}
-	request.Header.Set("Content-Type", MimeType)
-	request.Header.Set("Accept", MimeType)
 	response, err := t.transport.RoundTrip(request)
 	requestBuffer.Release()
 	if err != nil {
 		return nil, err
 	}
+	return ReadHTTPResponse(response)
+}
+
+func (t *HTTPSTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+// ReadHTTPResponse unpacks an RFC 8484 response and limits record TTLs by its HTTP freshness lifetime.
+func ReadHTTPResponse(response *http.Response) (*dns.Msg, error) {
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		return nil, E.New("unexpected status: ", response.Status)
 	}
-	var responseMessage dns.Msg
+	var (
+		responseMessage dns.Msg
+		err             error
+	)
 	if response.ContentLength > 0 {
 		responseBuffer := buf.NewSize(int(response.ContentLength))
+		defer responseBuffer.Release()
 		_, err = responseBuffer.ReadFullFrom(response.Body, int(response.ContentLength))
 		if err != nil {
 			return nil, err
 		}
 		err = responseMessage.Unpack(responseBuffer.Bytes())
-		responseBuffer.Release()
 	} else {
+		var rawMessage []byte
 		rawMessage, err = io.ReadAll(response.Body)
 		if err != nil {
 			return nil, err
@@ -116,9 +153,115 @@ func (t *HTTPSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.M
 	if err != nil {
 		return nil, err
 	}
+	applyHTTPFreshness(&responseMessage, response.Header)
 	return &responseMessage, nil
 }
 
-func (t *HTTPSTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
-	return nil, os.ErrInvalid
+// applyHTTPFreshness follows RFC 8484 section 5.1: record TTLs are reduced by the Age header
+// and capped by the remaining max-age, no-cache and no-store responses get a zero TTL.
+func applyHTTPFreshness(message *dns.Msg, header http.Header) {
+	var age uint32
+	if ageValue, err := strconv.ParseUint(strings.TrimSpace(header.Get("Age")), 10, 32); err == nil {
+		age = uint32(ageValue)
+	}
+	var (
+		maxAge       uint32
+		maxAgeLoaded bool
+	)
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			if maxAgeValue, err := strconv.ParseUint(strings.Trim(value, "\""), 10, 32); err == nil {
+				maxAge = uint32(maxAgeValue)
+				maxAgeLoaded = true
+			}
+		case "no-cache", "no-store":
+			maxAge = 0
+			maxAgeLoaded = true
+		}
+		if maxAgeLoaded && maxAge == 0 {
+			break
+		}
+	}
+	if age == 0 && !maxAgeLoaded {
+		return
+	}
+	var freshness uint32
+	if maxAgeLoaded && maxAge > age {
+		freshness = maxAge - age
+	}
+	for _, recordList := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, record := range recordList {
+			recordHeader := record.Header()
+			if recordHeader.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if recordHeader.Ttl > age {
+				recordHeader.Ttl -= age
+			} else {
+				recordHeader.Ttl = 0
+			}
+			if maxAgeLoaded && recordHeader.Ttl > freshness {
+				recordHeader.Ttl = freshness
+			}
+		}
+	}
+}
+
+// NewHTTPRequest builds an RFC 8484 request, GET requests carry the message in the dns query parameter.
+func NewHTTPRequest(ctx context.Context, options HTTPOptions, destination string, rawMessage []byte) (*http.Request, error) {
+	var (
+		request *http.Request
+		err     error
+	)
+	if options.Method != HTTPMethodPOST {
+		encodedMessage := base64.RawURLEncoding.EncodeToString(rawMessage)
+		var getURL string
+		if isURITemplate(destination) {
+			var loaded bool
+			getURL, loaded = expandURITemplate(destination, encodedMessage)
+			if !loaded {
+				return nil, E.New("URI template does not contain the dns variable")
+			}
+		} else if strings.Contains(destination, "?") {
+			getURL = destination + "&dns=" + encodedMessage
+		} else {
+			getURL = destination + "?dns=" + encodedMessage
+		}
+		if options.Method == HTTPMethodGET || len(getURL) <= maxHTTPGetURLLength {
+			request, err = http.NewRequestWithContext(ctx, http.MethodGet, getURL, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if request == nil {
+		if isURITemplate(destination) {
+			destination, _ = expandURITemplate(destination, "")
+		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodPost, destination, bytes.NewReader(rawMessage))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", MimeType)
+	}
+	request.Header.Set("Accept", MimeType)
+	applyHTTPHeaders(request, options.Headers)
+	if request.URL.User != nil {
+		password, _ := request.URL.User.Password()
+		request.SetBasicAuth(request.URL.User.Username(), password)
+		request.URL.User = nil
+	}
+	return request, nil
+}
+
+func applyHTTPHeaders(request *http.Request, headers http.Header) {
+	for key, values := range headers {
+		if strings.EqualFold(key, "Host") {
+			request.Host = values[0]
+			continue
+		}
+		request.Header[key] = values
+	}
 }
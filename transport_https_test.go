@@ -0,0 +1,267 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newHTTPSTestServer(t *testing.T, handler func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg)) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var rawMessage []byte
+		if request.Method == http.MethodPost {
+			rawMessage, _ = io.ReadAll(request.Body)
+		} else {
+			rawMessage, _ = base64.RawURLEncoding.DecodeString(request.URL.Query().Get("dns"))
+		}
+		var message mDNS.Msg
+		if message.Unpack(rawMessage) != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handler(writer, request, &message)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeHTTPSTestResponse(writer http.ResponseWriter, message *mDNS.Msg) {
+	response := new(mDNS.Msg)
+	response.SetReply(message)
+	response.Answer = append(response.Answer, &mDNS.A{
+		Hdr: mDNS.RR_Header{Name: message.Question[0].Name, Rrtype: mDNS.TypeA, Class: mDNS.ClassINET, Ttl: 300},
+		A:   []byte{1, 1, 1, 1},
+	})
+	rawResponse, _ := response.Pack()
+	writer.Header().Set("Content-Type", dns.MimeType)
+	writer.Write(rawResponse)
+}
+
+func TestHTTPSTransportTLS(t *testing.T) {
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	publicKeyHash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	for _, testCase := range []struct {
+		name    string
+		options dns.TLSOptions
+		success bool
+	}{
+		{"system roots", dns.TLSOptions{}, false},
+		{"custom roots", dns.TLSOptions{RootCAs: rootCAs}, true},
+		{"server name", dns.TLSOptions{RootCAs: rootCAs, ServerName: "example.com"}, true},
+		{"bad server name", dns.TLSOptions{RootCAs: rootCAs, ServerName: "example.org"}, false},
+		{"pinned", dns.TLSOptions{Insecure: true, PinnedPublicKeySHA256: [][]byte{publicKeyHash[:]}}, true},
+		{"bad pin", dns.TLSOptions{RootCAs: rootCAs, PinnedPublicKeySHA256: [][]byte{make([]byte, 32)}}, false},
+	} {
+		options := testCase.options
+		success := testCase.success
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Name:    "test-doh",
+				Address: server.URL + "/dns-query",
+				Dialer:  N.SystemDialer,
+				TLS:     options,
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+			if success {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "test-doh")
+			}
+		})
+	}
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: strings.Replace(server.URL, "https://", "https://user:secret@", 1) + "/dns-query",
+		Dialer:  N.SystemDialer,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+	require.ErrorContains(t, err, server.URL)
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func TestHTTPSTransportMethod(t *testing.T) {
+	methods := make(chan string, 1)
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		if request.URL.Query().Get("token") != "secret" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		methods <- request.Method
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	for _, testCase := range []struct {
+		name    string
+		method  dns.HTTPMethod
+		padding int
+		expect  string
+	}{
+		{"post", dns.HTTPMethodPOST, 0, http.MethodPost},
+		{"get", dns.HTTPMethodGET, 0, http.MethodGet},
+		{"auto", dns.HTTPMethodAuto, 0, http.MethodGet},
+		{"auto large", dns.HTTPMethodAuto, 2048, http.MethodPost},
+	} {
+		method := testCase.method
+		padding := testCase.padding
+		expect := testCase.expect
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: server.URL + "/dns-query?token=secret",
+				Dialer:  N.SystemDialer,
+				TLS:     dns.TLSOptions{RootCAs: rootCAs},
+				HTTP:    dns.HTTPOptions{Method: method},
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			message := new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA)
+			if padding > 0 {
+				message.SetEdns0(mDNS.DefaultMsgSize, false)
+				optRecord := message.IsEdns0()
+				optRecord.Option = append(optRecord.Option, &mDNS.EDNS0_PADDING{Padding: make([]byte, padding)})
+			}
+			_, err = transport.Exchange(context.Background(), message)
+			require.NoError(t, err)
+			require.Equal(t, expect, <-methods)
+		})
+	}
+}
+
+func TestHTTPSTransportTemplate(t *testing.T) {
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		username, password, _ := request.BasicAuth()
+		if request.URL.Path != "/dns-query" || request.UserAgent() != "sing-dns-test" ||
+			request.Header.Get("Authorization") != "Bearer token" && (username != "user" || password != "pass") {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	serverURL := server.URL + "/dns-query{?dns}"
+	for _, testCase := range []struct {
+		name    string
+		address string
+		method  dns.HTTPMethod
+		headers http.Header
+	}{
+		{"get", serverURL, dns.HTTPMethodGET, http.Header{"Authorization": []string{"Bearer token"}}},
+		{"post", serverURL, dns.HTTPMethodPOST, http.Header{"Authorization": []string{"Bearer token"}}},
+		{"basic auth", strings.Replace(serverURL, "https://", "https://user:pass@", 1), dns.HTTPMethodAuto, nil},
+	} {
+		address := testCase.address
+		httpOptions := dns.HTTPOptions{Method: testCase.method, Headers: testCase.headers.Clone()}
+		t.Run(testCase.name, func(t *testing.T) {
+			if httpOptions.Headers == nil {
+				httpOptions.Headers = make(http.Header)
+			}
+			httpOptions.Headers.Set("User-Agent", "sing-dns-test")
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: address,
+				Dialer:  N.SystemDialer,
+				TLS:     dns.TLSOptions{RootCAs: rootCAs},
+				HTTP:    httpOptions,
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHTTPSTransportCacheControl(t *testing.T) {
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		writer.Header().Set("Cache-Control", request.URL.Query().Get("cache-control"))
+		writer.Header().Set("Age", request.URL.Query().Get("age"))
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	for _, testCase := range []struct {
+		name         string
+		cacheControl string
+		age          string
+		ttl          uint32
+	}{
+		{"none", "", "", 300},
+		{"max-age", "public, max-age=100", "", 100},
+		{"max-age with age", "max-age=100", "30", 70},
+		{"stale", "max-age=100", "150", 0},
+		{"age only", "", "30", 270},
+		{"larger max-age", "max-age=3600", "30", 270},
+		{"no-store", "no-store, max-age=100", "", 0},
+	} {
+		query := url.Values{"cache-control": {testCase.cacheControl}, "age": {testCase.age}}
+		ttl := testCase.ttl
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: server.URL + "/dns-query?" + query.Encode(),
+				Dialer:  N.SystemDialer,
+				TLS:     dns.TLSOptions{RootCAs: rootCAs},
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			response, err := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA))
+			require.NoError(t, err)
+			require.Len(t, response.Answer, 1)
+			require.Equal(t, ttl, response.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestHTTPSTransportPadding(t *testing.T) {
+	queryLengths := make(chan int, 1)
+	server := newHTTPSTestServer(t, func(writer http.ResponseWriter, request *http.Request, message *mDNS.Msg) {
+		queryLengths <- message.Len()
+		writeHTTPSTestResponse(writer, message)
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: server.URL + "/dns-query",
+		Dialer:  N.SystemDialer,
+		TLS:     dns.TLSOptions{RootCAs: rootCAs},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	message := new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeA)
+	_, err = transport.Exchange(context.Background(), message)
+	require.NoError(t, err)
+	require.Equal(t, dns.PaddingBlockSize, <-queryLengths)
+	require.Empty(t, message.Extra)
+}
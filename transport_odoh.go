@@ -0,0 +1,375 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+)
+
+const (
+	ODoHMimeType   = "application/oblivious-dns-message"
+	ODoHConfigPath = "/.well-known/odohconfigs"
+)
+
+const (
+	odohVersion             = 0x0001
+	odohMessageTypeQuery    = 0x01
+	odohMessageTypeResponse = 0x02
+	odohPaddingBlockSize    = 128
+	odohMaxMessageSize      = 1 << 17
+)
+
+// ODoHOptions configures the odoh transport. Proxy is the URL of an oblivious proxy or
+// an ODoH relay stamp, queries are sent to the target directly when it is empty.
+// Configs holds the ObliviousDoHConfigs of the target. It is fetched from the target when
+// unset, which is only allowed without a proxy as the fetch would reveal the client address.
+type ODoHOptions struct {
+	Proxy   string
+	Configs []byte
+}
+
+var _ Transport = (*ODoHTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"odoh"}, func(options TransportOptions) (Transport, error) {
+		return NewODoHTransport(options)
+	})
+}
+
+type ODoHTransport struct {
+	name      string
+	target    *HTTPSTransport
+	proxy     *HTTPSTransport
+	configURL string
+	access    sync.Mutex
+	config    *odohConfig
+	static    bool
+}
+
+type odohConfig struct {
+	kem       hpke.KEM
+	kdf       hpke.KDF
+	aead      hpke.AEAD
+	publicKey kem.PublicKey
+	keyID     []byte
+}
+
+func NewODoHTransport(options TransportOptions) (*ODoHTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	serverURL.Scheme = "https"
+	if serverURL.Path == "" {
+		serverURL.Path = "/dns-query"
+	}
+	options.Address = serverURL.String()
+	options.HTTP.Method = HTTPMethodPOST
+	target := NewHTTPSTransport(options)
+	configURL := *serverURL
+	configURL.Path = ODoHConfigPath
+	configURL.RawQuery = ""
+	transport := &ODoHTransport{
+		name:      options.Name,
+		target:    target,
+		proxy:     target,
+		configURL: configURL.String(),
+	}
+	if len(options.ODoH.Configs) > 0 {
+		transport.config, err = parseODoHConfigs(options.ODoH.Configs)
+		if err != nil {
+			return nil, E.Cause(err, "parse ODoH configs")
+		}
+		transport.static = true
+	}
+	if options.ODoH.Proxy != "" {
+		if !transport.static {
+			return nil, E.New("ODoH configs are required with a proxy, fetching them from the target would reveal the client address")
+		}
+		targetHost := serverURL.Host
+		proxyOptions := options
+		proxyOptions.TLS.ServerName = ""
+		proxyOptions.TLS.PinnedPublicKeySHA256 = nil
+		proxyOptions.TLS.PinnedCertificateSHA256 = nil
+		proxyOptions.HTTP.Headers = options.HTTP.Headers.Clone()
+		if host := proxyOptions.HTTP.Headers.Get("Host"); host != "" {
+			targetHost = host
+			proxyOptions.HTTP.Headers.Del("Host")
+		}
+		proxyOptions.Address = options.ODoH.Proxy
+		if strings.HasPrefix(proxyOptions.Address, StampScheme) {
+			stamp, err := ParseStamp(proxyOptions.Address)
+			if err != nil {
+				return nil, E.Cause(err, "parse proxy stamp")
+			}
+			if stamp.Protocol != StampProtocolODoHRelay {
+				return nil, E.New("not an ODoH relay stamp: ", stamp.Protocol)
+			}
+			proxyOptions, err = stamp.transportOptions(proxyOptions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		proxyURL, err := url.Parse(proxyOptions.Address)
+		if err != nil {
+			return nil, E.Cause(err, "parse proxy URL")
+		}
+		query := proxyURL.Query()
+		query.Set("targethost", targetHost)
+		query.Set("targetpath", serverURL.Path)
+		proxyURL.RawQuery = query.Encode()
+		proxyOptions.Address = proxyURL.String()
+		transport.proxy = NewHTTPSTransport(proxyOptions)
+	}
+	return transport, nil
+}
+
+func (t *ODoHTransport) Name() string {
+	return t.name
+}
+
+func (t *ODoHTransport) Start() error {
+	return nil
+}
+
+func (t *ODoHTransport) Reset() {
+	t.target.Reset()
+	if t.proxy != t.target {
+		t.proxy.Reset()
+	}
+}
+
+func (t *ODoHTransport) Close() error {
+	t.Reset()
+	return nil
+}
+
+func (t *ODoHTransport) Raw() bool {
+	return true
+}
+
+func (t *ODoHTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	config, err := t.loadConfig(ctx)
+	if err != nil {
+		return nil, E.Cause(err, "fetch ODoH configs")
+	}
+	exMessage := *message
+	exMessage.Id = 0
+	exMessage.Compress = true
+	rawMessage, err := exMessage.Pack()
+	if err != nil {
+		return nil, err
+	}
+	plaintext := odohPlaintext(rawMessage, odohPaddingBlockSize)
+	encryptedQuery, sealer, err := config.sealQuery(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	request, err := NewHTTPRequest(ctx, t.proxy.options, t.proxy.destination, encryptedQuery)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", ODoHMimeType)
+	request.Header.Set("Accept", ODoHMimeType)
+	response, err := t.proxy.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusBadRequest {
+			// the target may have rotated its keys
+			t.access.Lock()
+			if t.config == config && !t.static {
+				t.config = nil
+			}
+			t.access.Unlock()
+		}
+		return nil, E.New("unexpected status: ", response.Status)
+	}
+	encryptedResponse, err := io.ReadAll(io.LimitReader(response.Body, odohMaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	rawResponse, err := config.openResponse(sealer, plaintext, encryptedResponse)
+	if err != nil {
+		return nil, E.Cause(err, "decrypt ODoH response")
+	}
+	var responseMessage dns.Msg
+	err = responseMessage.Unpack(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+	applyHTTPFreshness(&responseMessage, response.Header)
+	return &responseMessage, nil
+}
+
+func (t *ODoHTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *ODoHTransport) loadConfig(ctx context.Context) (*odohConfig, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.config != nil {
+		return t.config, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, t.configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	applyHTTPHeaders(request, t.target.options.Headers)
+	response, err := t.target.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, E.New("unexpected status: ", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, odohMaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseODoHConfigs(content)
+	if err != nil {
+		return nil, err
+	}
+	t.config = config
+	return config, nil
+}
+
+// parseODoHConfigs picks the first supported configuration from an ObliviousDoHConfigs structure.
+func parseODoHConfigs(content []byte) (*odohConfig, error) {
+	if len(content) < 2 || int(binary.BigEndian.Uint16(content)) != len(content)-2 {
+		return nil, E.New("invalid ODoH configs length")
+	}
+	content = content[2:]
+	for len(content) > 0 {
+		if len(content) < 4 {
+			return nil, E.New("invalid ODoH config")
+		}
+		version := binary.BigEndian.Uint16(content)
+		length := int(binary.BigEndian.Uint16(content[2:]))
+		if len(content) < 4+length {
+			return nil, E.New("invalid ODoH config length")
+		}
+		contents := content[4 : 4+length]
+		content = content[4+length:]
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		config := &odohConfig{
+			kem:  hpke.KEM(binary.BigEndian.Uint16(contents)),
+			kdf:  hpke.KDF(binary.BigEndian.Uint16(contents[2:])),
+			aead: hpke.AEAD(binary.BigEndian.Uint16(contents[4:])),
+		}
+		publicKeyLength := int(binary.BigEndian.Uint16(contents[6:]))
+		if len(contents) != 8+publicKeyLength || !config.kem.IsValid() || !config.kdf.IsValid() || !config.aead.IsValid() {
+			continue
+		}
+		publicKey, err := config.kem.Scheme().UnmarshalBinaryPublicKey(contents[8:])
+		if err != nil {
+			continue
+		}
+		config.publicKey = publicKey
+		config.keyID = config.kdf.Expand(config.kdf.Extract(contents, nil), []byte("odoh key id"), uint(config.kdf.ExtractSize()))
+		return config, nil
+	}
+	return nil, E.New("no supported ODoH config")
+}
+
+func odohPlaintext(rawMessage []byte, blockSize int) []byte {
+	paddingLength := (blockSize - len(rawMessage)%blockSize) % blockSize
+	plaintext := make([]byte, 0, 4+len(rawMessage)+paddingLength)
+	plaintext = binary.BigEndian.AppendUint16(plaintext, uint16(len(rawMessage)))
+	plaintext = append(plaintext, rawMessage...)
+	plaintext = binary.BigEndian.AppendUint16(plaintext, uint16(paddingLength))
+	return append(plaintext, make([]byte, paddingLength)...)
+}
+
+func appendODoHMessage(buffer []byte, messageType byte, keyID []byte, encryptedMessage []byte) []byte {
+	buffer = append(buffer, messageType)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(keyID)))
+	buffer = append(buffer, keyID...)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(encryptedMessage)))
+	return append(buffer, encryptedMessage...)
+}
+
+func (c *odohConfig) sealQuery(plaintext []byte) ([]byte, hpke.Sealer, error) {
+	sender, err := hpke.NewSuite(c.kem, c.kdf, c.aead).NewSender(c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	encapsulatedKey, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	additionalData := appendODoHAdditionalData(odohMessageTypeQuery, c.keyID)
+	ciphertext, err := sealer.Seal(plaintext, additionalData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return appendODoHMessage(nil, odohMessageTypeQuery, c.keyID, append(encapsulatedKey, ciphertext...)), sealer, nil
+}
+
+func (c *odohConfig) openResponse(sealer hpke.Sealer, queryPlaintext []byte, content []byte) ([]byte, error) {
+	if len(content) < 3 || content[0] != odohMessageTypeResponse {
+		return nil, E.New("invalid message type")
+	}
+	nonceLength := int(binary.BigEndian.Uint16(content[1:]))
+	if len(content) < 5+nonceLength {
+		return nil, E.New("invalid message length")
+	}
+	responseNonce := content[3 : 3+nonceLength]
+	encryptedLength := int(binary.BigEndian.Uint16(content[3+nonceLength:]))
+	if len(content) != 5+nonceLength+encryptedLength {
+		return nil, E.New("invalid message length")
+	}
+	secret := sealer.Export([]byte("odoh response"), c.aead.KeySize())
+	salt := binary.BigEndian.AppendUint16(append([]byte{}, queryPlaintext...), uint16(nonceLength))
+	salt = append(salt, responseNonce...)
+	pseudorandomKey := c.kdf.Extract(secret, salt)
+	key := c.kdf.Expand(pseudorandomKey, []byte("odoh key"), c.aead.KeySize())
+	nonce := c.kdf.Expand(pseudorandomKey, []byte("odoh nonce"), c.aead.NonceSize())
+	aead, err := c.aead.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, content[5+nonceLength:], appendODoHAdditionalData(odohMessageTypeResponse, responseNonce))
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < 4 {
+		return nil, E.New("invalid plaintext")
+	}
+	messageLength := int(binary.BigEndian.Uint16(plaintext))
+	if len(plaintext) < 4+messageLength {
+		return nil, E.New("invalid plaintext")
+	}
+	padding := plaintext[4+messageLength:]
+	if int(binary.BigEndian.Uint16(plaintext[2+messageLength:])) != len(padding) ||
+		subtle.ConstantTimeCompare(padding, make([]byte, len(padding))) != 1 {
+		return nil, E.New("invalid padding")
+	}
+	return plaintext[2 : 2+messageLength], nil
+}
+
+func appendODoHAdditionalData(messageType byte, keyID []byte) []byte {
+	additionalData := binary.BigEndian.AppendUint16([]byte{messageType}, uint16(len(keyID)))
+	return append(additionalData, keyID...)
+}
@@ -0,0 +1,152 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/cloudflare/circl/hpke"
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newODoHTestTarget serves a single X25519/HKDF-SHA256/AES-128-GCM configuration and answers
+// every query with a TXT echo.
+func newODoHTestTarget(t *testing.T) (*httptest.Server, []byte) {
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	publicKey, privateKey, err := hpke.KEM_X25519_HKDF_SHA256.Scheme().GenerateKeyPair()
+	require.NoError(t, err)
+	rawPublicKey, err := publicKey.MarshalBinary()
+	require.NoError(t, err)
+	contents := []byte{0, 0x20, 0, 0x01, 0, 0x01}
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(rawPublicKey)))
+	contents = append(contents, rawPublicKey...)
+	config := binary.BigEndian.AppendUint16([]byte{0, 1}, uint16(len(contents)))
+	config = append(config, contents...)
+	configs := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	configs = append(configs, config...)
+	keyID := hpke.KDF_HKDF_SHA256.Expand(hpke.KDF_HKDF_SHA256.Extract(contents, nil), []byte("odoh key id"), 32)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == dns.ODoHConfigPath {
+			writer.Write(configs)
+			return
+		}
+		body, _ := io.ReadAll(request.Body)
+		if request.Header.Get("Content-Type") != dns.ODoHMimeType || len(body) < 3 || body[0] != 0x01 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		keyIDLength := int(binary.BigEndian.Uint16(body[1:]))
+		if !bytes.Equal(body[3:3+keyIDLength], keyID) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		encrypted := body[5+keyIDLength:]
+		receiver, _ := suite.NewReceiver(privateKey, []byte("odoh query"))
+		opener, err := receiver.Setup(encrypted[:32])
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		queryPlaintext, err := opener.Open(encrypted[32:], body[:3+keyIDLength])
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var message mDNS.Msg
+		if message.Unpack(queryPlaintext[2:2+binary.BigEndian.Uint16(queryPlaintext)]) != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rawResponse, _ := newTestAnswer(&message).Pack()
+		responsePlaintext := binary.BigEndian.AppendUint16(nil, uint16(len(rawResponse)))
+		responsePlaintext = append(responsePlaintext, rawResponse...)
+		responsePlaintext = append(responsePlaintext, 0, 0)
+		responseNonce := make([]byte, 16)
+		rand.Read(responseNonce)
+		secret := opener.Export([]byte("odoh response"), 16)
+		salt := binary.BigEndian.AppendUint16(append([]byte{}, queryPlaintext...), uint16(len(responseNonce)))
+		pseudorandomKey := hpke.KDF_HKDF_SHA256.Extract(secret, append(salt, responseNonce...))
+		aead, _ := hpke.AEAD_AES128GCM.New(hpke.KDF_HKDF_SHA256.Expand(pseudorandomKey, []byte("odoh key"), 16))
+		additionalData := binary.BigEndian.AppendUint16([]byte{0x02}, uint16(len(responseNonce)))
+		additionalData = append(additionalData, responseNonce...)
+		encryptedResponse := aead.Seal(nil, hpke.KDF_HKDF_SHA256.Expand(pseudorandomKey, []byte("odoh nonce"), 12), responsePlaintext, additionalData)
+		writer.Header().Set("Content-Type", dns.ODoHMimeType)
+		writer.Write(append(binary.BigEndian.AppendUint16(additionalData, uint16(len(encryptedResponse))), encryptedResponse...))
+	}))
+	t.Cleanup(server.Close)
+	return server, configs
+}
+
+func TestODoHTransport(t *testing.T) {
+	target, configs := newODoHTestTarget(t)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(target.Certificate())
+	proxyClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+	proxied := make(chan string, 1)
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		targetURL := "https://" + request.URL.Query().Get("targethost") + request.URL.Query().Get("targetpath")
+		proxied <- targetURL
+		response, err := proxyClient.Post(targetURL, request.Header.Get("Content-Type"), request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		writer.WriteHeader(response.StatusCode)
+		io.Copy(writer, response.Body)
+	}))
+	defer proxy.Close()
+	for _, testCase := range []struct {
+		name    string
+		options dns.ODoHOptions
+	}{
+		{"direct", dns.ODoHOptions{}},
+		{"direct configs", dns.ODoHOptions{Configs: configs}},
+		{"proxy", dns.ODoHOptions{Proxy: proxy.URL + "/proxy", Configs: configs}},
+	} {
+		options := testCase.options
+		proxyURL := options.Proxy
+		t.Run(testCase.name, func(t *testing.T) {
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Address: strings.Replace(target.URL, "https://", "odoh://", 1) + "/dns-query",
+				Dialer:  N.SystemDialer,
+				TLS:     dns.TLSOptions{RootCAs: rootCAs},
+				ODoH:    options,
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			for _, name := range []string{"example.com.", "example.org."} {
+				response, err := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT))
+				require.NoError(t, err)
+				require.Len(t, response.Answer, 1)
+				require.Equal(t, name, response.Answer[0].Header().Name)
+				if proxyURL != "" {
+					require.Equal(t, target.URL+"/dns-query", <-proxied)
+				}
+			}
+		})
+	}
+	_, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: strings.Replace(target.URL, "https://", "odoh://", 1) + "/dns-query",
+		Dialer:  N.SystemDialer,
+		ODoH:    dns.ODoHOptions{Proxy: proxy.URL + "/proxy"},
+	})
+	require.ErrorContains(t, err, "ODoH configs are required")
+}
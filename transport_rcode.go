@@ -5,12 +5,25 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	E "github.com/sagernet/sing/common/exceptions"
 
 	"github.com/miekg/dns"
 )
 
+const DefaultBlockTTL = 60
+
+// BlockOptions configures the answers of the rcode transport. Addresses answer A and AAAA
+// queries in place of the rcode, negative answers carry a synthetic SOA so they can be cached.
+type BlockOptions struct {
+	Addresses     []netip.Addr
+	TTL           uint32
+	NegativeTTL   uint32
+	ExtendedError *dns.EDNS0_EDE
+}
+
 var _ Transport = (*RCodeTransport)(nil)
 
 func init() {
@@ -20,31 +33,64 @@ func init() {
 }
 
 type RCodeTransport struct {
-	name string
-	code RCodeError
+	name          string
+	code          RCodeError
+	addresses     []netip.Addr
+	ttl           uint32
+	negativeTTL   uint32
+	extendedError *dns.EDNS0_EDE
 }
 
+// NewRCodeTransport accepts rcode://<rcode> with the rcode as a name such as name_error
+// or nxdomain, or as a number, extended rcodes included. rcode://nodata answers NOERROR
+// without records, rcode://null answers 0.0.0.0 and ::, and rcode://address answers Block.Addresses.
 func NewRCodeTransport(options TransportOptions) (*RCodeTransport, error) {
 	serverURL, err := url.Parse(options.Address)
 	if err != nil {
 		return nil, err
 	}
+	transport := &RCodeTransport{
+		name:          options.Name,
+		addresses:     options.Block.Addresses,
+		ttl:           options.Block.TTL,
+		negativeTTL:   options.Block.NegativeTTL,
+		extendedError: options.Block.ExtendedError,
+	}
+	if transport.ttl == 0 {
+		transport.ttl = DefaultBlockTTL
+	}
+	if transport.negativeTTL == 0 {
+		transport.negativeTTL = DefaultBlockTTL
+	}
 	switch serverURL.Host {
-	case "success":
-		return &RCodeTransport{options.Name, RCodeSuccess}, nil
+	case "success", "nodata":
+		transport.code = RCodeSuccess
 	case "format_error":
-		return &RCodeTransport{options.Name, RCodeFormatError}, nil
+		transport.code = RCodeFormatError
 	case "server_failure":
-		return &RCodeTransport{options.Name, RCodeServerFailure}, nil
+		transport.code = RCodeServerFailure
 	case "name_error":
-		return &RCodeTransport{options.Name, RCodeNameError}, nil
+		transport.code = RCodeNameError
 	case "not_implemented":
-		return &RCodeTransport{options.Name, RCodeNotImplemented}, nil
+		transport.code = RCodeNotImplemented
 	case "refused":
-		return &RCodeTransport{options.Name, RCodeRefused}, nil
+		transport.code = RCodeRefused
+	case "null":
+		transport.addresses = []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}
+	case "address":
+		if len(transport.addresses) == 0 {
+			return nil, E.New("missing block addresses")
+		}
 	default:
-		return nil, E.New("unknown rcode: " + options.Name)
+		if code, loaded := dns.StringToRcode[strings.ToUpper(serverURL.Host)]; loaded {
+			transport.code = RCodeError(code)
+		} else if code, parseErr := strconv.ParseUint(serverURL.Host, 10, 12); parseErr == nil {
+			transport.code = RCodeError(code)
+		} else {
+			return nil, E.New("unknown rcode: " + serverURL.Host)
+		}
 	}
+	return transport, nil
 }
 
 func (t *RCodeTransport) Name() string {
@@ -67,10 +113,44 @@ func (t *RCodeTransport) Raw() bool {
 }
 
 func (t *RCodeTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
-	exMessage := *message
-	exMessage.Response = true
-	exMessage.Rcode = int(t.code)
-	return &exMessage, nil
+	response := new(dns.Msg)
+	response.SetRcode(message, int(t.code))
+	response.RecursionAvailable = true
+	if len(message.Question) > 0 {
+		question := message.Question[0]
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: t.ttl}
+		for _, address := range t.addresses {
+			if question.Qtype == dns.TypeA && address.Is4() {
+				response.Answer = append(response.Answer, &dns.A{Hdr: header, A: address.AsSlice()})
+			} else if question.Qtype == dns.TypeAAAA && address.Is6() {
+				response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: address.AsSlice()})
+			}
+		}
+		if len(response.Answer) == 0 && (t.code == RCodeSuccess || t.code == RCodeNameError) {
+			response.Ns = append(response.Ns, &dns.SOA{
+				Hdr:     dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: t.negativeTTL},
+				Ns:      "invalid.",
+				Mbox:    "hostmaster.invalid.",
+				Serial:  1,
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				Minttl:  t.negativeTTL,
+			})
+		}
+	}
+	// RFC 6891: responders only include OPT when the query did, extended rcodes can not be sent without it
+	if message.IsEdns0() != nil || t.code > 0xF {
+		response.SetEdns0(dns.DefaultMsgSize, false)
+		if t.extendedError != nil {
+			optRecord := response.IsEdns0()
+			optRecord.Option = append(optRecord.Option, &dns.EDNS0_EDE{
+				InfoCode:  t.extendedError.InfoCode,
+				ExtraText: t.extendedError.ExtraText,
+			})
+		}
+	}
+	return response, nil
 }
 
 func (t *RCodeTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
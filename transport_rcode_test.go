@@ -0,0 +1,70 @@
+package dns_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRCodeTransport(t *testing.T) {
+	newTransport := func(address string, options dns.BlockOptions) dns.Transport {
+		transport, err := dns.CreateTransport(dns.TransportOptions{
+			Context: context.Background(),
+			Logger:  logger.NOP(),
+			Address: address,
+			Block:   options,
+		})
+		require.NoError(t, err)
+		return transport
+	}
+	client := dns.NewClient(dns.ClientOptions{DisableCache: true})
+	exchange := func(transport dns.Transport, qType uint16, edns bool) *mDNS.Msg {
+		request := new(mDNS.Msg).SetQuestion("ads.example.com.", qType)
+		if edns {
+			request.SetEdns0(1232, false)
+		}
+		response, err := client.Exchange(context.Background(), transport, request, dns.DomainStrategyAsIS)
+		require.NoError(t, err)
+		return response
+	}
+
+	response := exchange(newTransport("rcode://nxdomain", dns.BlockOptions{NegativeTTL: 30}), mDNS.TypeA, false)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Len(t, response.Ns, 1)
+	require.Equal(t, uint32(30), response.Ns[0].(*mDNS.SOA).Minttl)
+	require.Nil(t, response.IsEdns0())
+
+	response = exchange(newTransport("rcode://null", dns.BlockOptions{}), mDNS.TypeAAAA, false)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "::", response.Answer[0].(*mDNS.AAAA).AAAA.String())
+
+	transport := newTransport("rcode://address", dns.BlockOptions{
+		Addresses:     []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		ExtendedError: &mDNS.EDNS0_EDE{InfoCode: mDNS.ExtendedErrorCodeBlocked, ExtraText: "ads"},
+	})
+	response = exchange(transport, mDNS.TypeA, true)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(dns.DefaultBlockTTL), response.Answer[0].Header().Ttl)
+	require.Len(t, response.IsEdns0().Option, 1)
+	require.Equal(t, mDNS.ExtendedErrorCodeBlocked, response.IsEdns0().Option[0].(*mDNS.EDNS0_EDE).InfoCode)
+	response = exchange(transport, mDNS.TypeAAAA, true)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Len(t, response.Ns, 1)
+
+	response = exchange(newTransport("rcode://badcookie", dns.BlockOptions{}), mDNS.TypeA, false)
+	packet, err := response.Pack()
+	require.NoError(t, err)
+	response = new(mDNS.Msg)
+	require.NoError(t, response.Unpack(packet))
+	require.Equal(t, mDNS.RcodeBadCookie, response.Rcode)
+
+	_, err = dns.CreateTransport(dns.TransportOptions{Context: context.Background(), Address: "rcode://address"})
+	require.Error(t, err)
+}
@@ -0,0 +1,350 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultResolvConfPath         = "/etc/resolv.conf"
+	systemResolvConfCheckInterval = 5 * time.Second
+)
+
+var _ Transport = (*SystemTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"system"}, func(options TransportOptions) (Transport, error) {
+		return NewSystemTransport(options)
+	})
+}
+
+// SystemTransport sends queries to the name servers listed in resolv.conf, which is
+// checked for changes at most every five seconds. Address is "system" or system:///path/to/resolv.conf.
+type SystemTransport struct {
+	options   TransportOptions
+	path      string
+	access    sync.Mutex
+	config    *resolvConfig
+	servers   []*UDPTransport
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+	next      uint32
+}
+
+type resolvConfig struct {
+	servers  []M.Socksaddr
+	search   []string
+	ndots    int
+	timeout  time.Duration
+	attempts int
+	rotate   bool
+}
+
+func NewSystemTransport(options TransportOptions) (*SystemTransport, error) {
+	path := DefaultResolvConfPath
+	if options.Address != "system" {
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		if serverURL.Path != "" {
+			path = serverURL.Path
+		}
+	}
+	return &SystemTransport{
+		options: options,
+		path:    path,
+	}, nil
+}
+
+func (t *SystemTransport) Name() string {
+	return t.options.Name
+}
+
+func (t *SystemTransport) Start() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	return t.reload(true)
+}
+
+func (t *SystemTransport) Reset() {
+	t.access.Lock()
+	defer t.access.Unlock()
+	for _, server := range t.servers {
+		server.Reset()
+	}
+}
+
+func (t *SystemTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	var errors []error
+	for _, server := range t.servers {
+		errors = append(errors, server.Close())
+	}
+	t.servers = nil
+	t.config = nil
+	return E.Errors(errors...)
+}
+
+func (t *SystemTransport) Raw() bool {
+	return true
+}
+
+func (t *SystemTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	t.access.Lock()
+	err := t.reload(false)
+	config := t.config
+	servers := t.servers
+	var offset int
+	if config != nil && config.rotate {
+		offset = int(t.next)
+		t.next++
+	}
+	t.access.Unlock()
+	if err != nil {
+		if config == nil {
+			return nil, err
+		}
+		t.options.Logger.WarnContext(ctx, E.Cause(err, "reload ", t.path))
+	}
+	if len(message.Question) == 0 {
+		return t.exchange(ctx, config, servers, offset, message)
+	}
+	question := message.Question[0]
+	var (
+		response *dns.Msg
+		lastErr  error
+	)
+	for _, name := range config.nameList(question.Name) {
+		exMessage := *message
+		exMessage.Question = []dns.Question{{Name: name, Qtype: question.Qtype, Qclass: question.Qclass}}
+		nameResponse, err := t.exchange(ctx, config, servers, offset, &exMessage)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if nameResponse.Rcode == dns.RcodeNameError || nameResponse.Rcode == dns.RcodeSuccess && len(nameResponse.Answer) == 0 {
+			// as in glibc, the first NODATA wins over NXDOMAIN for the other names
+			if response == nil || response.Rcode == dns.RcodeNameError {
+				response = nameResponse
+			}
+			continue
+		}
+		response = nameResponse
+		break
+	}
+	if response == nil {
+		return nil, lastErr
+	}
+	if len(response.Question) == 0 {
+		return response, nil
+	}
+	if name := response.Question[0].Name; !strings.EqualFold(name, question.Name) {
+		response.Question = message.Question
+		if len(response.Answer) > 0 {
+			response.Answer = append([]dns.RR{&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: question.Qclass, Ttl: response.Answer[0].Header().Ttl},
+				Target: name,
+			}}, response.Answer...)
+		}
+	}
+	return response, nil
+}
+
+func (t *SystemTransport) exchange(ctx context.Context, config *resolvConfig, servers []*UDPTransport, offset int, message *dns.Msg) (*dns.Msg, error) {
+	var errors []error
+	for attempt := 0; attempt < config.attempts; attempt++ {
+		for index := range servers {
+			server := servers[(offset+index)%len(servers)]
+			exchangeCtx, cancel := context.WithTimeout(ctx, config.timeout)
+			response, err := server.Exchange(exchangeCtx, message)
+			cancel()
+			if err == nil {
+				return response, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errors = append(errors, err)
+		}
+	}
+	return nil, E.Errors(errors...)
+}
+
+func (t *SystemTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+// reload parses resolv.conf again if it changed since the last check, the caller must hold access.
+func (t *SystemTransport) reload(force bool) error {
+	now := time.Now()
+	if !force && t.config != nil && now.Sub(t.checkedAt) < systemResolvConfCheckInterval {
+		return nil
+	}
+	t.checkedAt = now
+	var (
+		modTime time.Time
+		size    int64
+	)
+	fileInfo, err := os.Stat(t.path)
+	if err == nil {
+		modTime = fileInfo.ModTime()
+		size = fileInfo.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if !force && t.config != nil && modTime.Equal(t.modTime) && size == t.size {
+		return nil
+	}
+	config := defaultResolvConfig()
+	if fileInfo != nil {
+		file, err := os.Open(t.path)
+		if err != nil {
+			return err
+		}
+		config, err = parseResolvConf(file)
+		file.Close()
+		if err != nil {
+			return E.Cause(err, "parse ", t.path)
+		}
+	}
+	servers := make([]*UDPTransport, 0, len(config.servers))
+	for _, serverAddr := range config.servers {
+		serverOptions := t.options
+		serverOptions.Address = serverAddr.String()
+		server, err := NewUDPTransport(serverOptions)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	for _, server := range t.servers {
+		server.Close()
+	}
+	if t.config != nil {
+		t.options.Logger.Info("reloaded ", t.path)
+	}
+	t.config = config
+	t.servers = servers
+	t.modTime = modTime
+	t.size = size
+	return nil
+}
+
+func defaultResolvConfig() *resolvConfig {
+	return &resolvConfig{
+		servers: []M.Socksaddr{
+			M.SocksaddrFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 53),
+			M.SocksaddrFrom(netip.IPv6Loopback(), 53),
+		},
+		ndots:    1,
+		timeout:  5 * time.Second,
+		attempts: 2,
+	}
+}
+
+// parseResolvConf follows resolv.conf(5): the last domain or search line wins and options
+// not understood here are ignored.
+func parseResolvConf(reader io.Reader) (*resolvConfig, error) {
+	config := defaultResolvConfig()
+	config.servers = nil
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			host := fields[1]
+			if index := strings.IndexByte(host, '%'); index >= 0 {
+				host = host[:index]
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				continue
+			}
+			config.servers = append(config.servers, M.SocksaddrFrom(addr, 53))
+		case "domain":
+			config.search = []string{dns.Fqdn(fields[1])}
+		case "search":
+			config.search = config.search[:0]
+			for _, domain := range fields[1:] {
+				if domain != "." {
+					config.search = append(config.search, dns.Fqdn(domain))
+				}
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				switch name {
+				case "ndots":
+					if ndots, err := strconv.Atoi(value); err == nil && ndots >= 0 {
+						if ndots > 15 {
+							ndots = 15
+						}
+						config.ndots = ndots
+					}
+				case "timeout":
+					if timeout, err := strconv.Atoi(value); err == nil && timeout >= 1 {
+						if timeout > 30 {
+							timeout = 30
+						}
+						config.timeout = time.Duration(timeout) * time.Second
+					}
+				case "attempts":
+					if attempts, err := strconv.Atoi(value); err == nil && attempts >= 1 {
+						if attempts > 5 {
+							attempts = 5
+						}
+						config.attempts = attempts
+					}
+				case "rotate":
+					config.rotate = true
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(config.servers) == 0 {
+		config.servers = defaultResolvConfig().servers
+	}
+	return config, nil
+}
+
+// nameList returns the names to query in order, names with fewer dots than ndots
+// are tried with the search domains first.
+func (c *resolvConfig) nameList(name string) []string {
+	if len(c.search) == 0 || name == "." {
+		return []string{name}
+	}
+	names := make([]string, 0, len(c.search)+1)
+	for _, domain := range c.search {
+		names = append(names, name+domain)
+	}
+	if strings.Count(name, ".")-1 >= c.ndots {
+		return append([]string{name}, names...)
+	}
+	return append(names, name)
+}
@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	config, err := parseResolvConf(strings.NewReader(`# generated
+domain example.org
+nameserver 192.0.2.1
+nameserver fe80::1%eth0 ; link local
+nameserver not-an-address
+search corp.example.com. example.com
+options ndots:2 timeout:1 attempts:9 rotate edns0
+`))
+	require.NoError(t, err)
+	require.Len(t, config.servers, 2)
+	require.Equal(t, "192.0.2.1:53", config.servers[0].String())
+	require.Equal(t, "[fe80::1]:53", config.servers[1].String())
+	require.Equal(t, []string{"corp.example.com.", "example.com."}, config.search)
+	require.Equal(t, 2, config.ndots)
+	require.Equal(t, time.Second, config.timeout)
+	require.Equal(t, 5, config.attempts)
+	require.True(t, config.rotate)
+	require.Equal(t, []string{"host.corp.example.com.", "host.example.com.", "host."}, config.nameList("host."))
+	require.Equal(t, []string{"a.b.c.", "a.b.c.corp.example.com.", "a.b.c.example.com."}, config.nameList("a.b.c."))
+}
+
+func TestSystemTransport(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, source, readErr := conn.ReadFrom(buffer)
+			if readErr != nil {
+				return
+			}
+			var message dns.Msg
+			if message.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := new(dns.Msg)
+			response.SetReply(&message)
+			switch message.Question[0].Name {
+			case "host.example.com.":
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: message.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(192, 0, 2, 1),
+				})
+			case "nodata.example.":
+			default:
+				response.Rcode = dns.RcodeNameError
+			}
+			rawResponse, _ := response.Pack()
+			conn.WriteTo(rawResponse, source)
+		}
+	}()
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("nameserver 127.0.0.1\nsearch corp.example.com example.com\n"), 0o644))
+	transport, err := CreateTransport(TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "system://" + path,
+		Dialer:  N.SystemDialer,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Start())
+	systemTransport := transport.(*SystemTransport)
+	// resolv.conf can not carry a port, point the parsed server at the test listener instead.
+	server, err := NewUDPTransport(TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: conn.LocalAddr().String(),
+		Dialer:  N.SystemDialer,
+	})
+	require.NoError(t, err)
+	systemTransport.servers[0].Close()
+	systemTransport.servers[0] = server
+
+	response, err := transport.Exchange(context.Background(), new(dns.Msg).SetQuestion("host.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "host.", response.Question[0].Name)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "host.example.com.", response.Answer[0].(*dns.CNAME).Target)
+
+	// the absolute name is tried first and exists, NXDOMAIN for the search names must not hide it
+	response, err = transport.Exchange(context.Background(), new(dns.Msg).SetQuestion("nodata.example.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Equal(t, "nodata.example.", response.Question[0].Name)
+
+	require.NoError(t, os.WriteFile(path, []byte("nameserver 192.0.2.53\nnameserver 192.0.2.54\noptions rotate\n"), 0o644))
+	systemTransport.checkedAt = time.Time{}
+	systemTransport.modTime = time.Time{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = transport.Exchange(ctx, new(dns.Msg).SetQuestion("host.", dns.TypeA))
+	require.Error(t, err)
+	require.Len(t, systemTransport.servers, 2)
+	require.True(t, systemTransport.config.rotate)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/binary"
 	"io"
+	"net"
 	"net/netip"
 	"net/url"
 	"os"
@@ -29,6 +30,7 @@ type TCPTransport struct {
 	name       string
 	dialer     N.Dialer
 	serverAddr M.Socksaddr
+	pool       *pipelinePool
 }
 
 func NewTCPTransport(options TransportOptions) (*TCPTransport, error) {
@@ -47,11 +49,13 @@ func NewTCPTransport(options TransportOptions) (*TCPTransport, error) {
 }
 
 func newTCPTransport(options TransportOptions, serverAddr M.Socksaddr) *TCPTransport {
-	return &TCPTransport{
+	transport := &TCPTransport{
 		name:       options.Name,
 		dialer:     options.Dialer,
 		serverAddr: serverAddr,
 	}
+	transport.pool = newPipelinePool(options.Pipeline, false, transport.dial)
+	return transport
 }
 
 func (t *TCPTransport) Name() string {
@@ -63,9 +67,11 @@ func (t *TCPTransport) Start() error {
 }
 
 func (t *TCPTransport) Reset() {
+	t.pool.Reset()
 }
 
 func (t *TCPTransport) Close() error {
+	t.Reset()
 	return nil
 }
 
@@ -74,16 +80,11 @@ func (t *TCPTransport) Raw() bool {
 }
 
 func (t *TCPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
-	conn, err := t.dialer.DialContext(ctx, N.NetworkTCP, t.serverAddr)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	err = writeMessage(conn, 0, message)
-	if err != nil {
-		return nil, err
-	}
-	return readMessage(conn)
+	return t.pool.Exchange(ctx, message)
+}
+
+func (t *TCPTransport) dial(ctx context.Context) (net.Conn, error) {
+	return t.dialer.DialContext(ctx, N.NetworkTCP, t.serverAddr)
 }
 
 func (t *TCPTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
@@ -111,17 +112,19 @@ func readMessage(reader io.Reader) (*dns.Msg, error) {
 }
 
 func writeMessage(writer io.Writer, messageId uint16, message *dns.Msg) error {
-	requestLen := message.Len()
-	buffer := buf.NewSize(3 + requestLen)
-	defer buffer.Release()
-	common.Must(binary.Write(buffer, binary.BigEndian, uint16(requestLen)))
 	exMessage := *message
 	exMessage.Id = messageId
+	exMessage.Compress = false
+	// the uncompressed length bounds the packed one, the prefix is written after packing
+	buffer := buf.NewSize(3 + exMessage.Len())
+	defer buffer.Release()
 	exMessage.Compress = true
+	lengthBytes := buffer.Extend(2)
 	rawMessage, err := exMessage.PackBuffer(buffer.FreeBytes())
 	if err != nil {
 		return err
 	}
+	binary.BigEndian.PutUint16(lengthBytes, uint16(len(rawMessage)))
 	buffer.Truncate(2 + len(rawMessage))
 	return common.Error(writer.Write(buffer.Bytes()))
 }
@@ -0,0 +1,165 @@
+package dns_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTestStream answers every batch of queries on a connection in reverse order.
+func serveTestStream(conn net.Conn, batch int, handler func(message *mDNS.Msg) *mDNS.Msg) {
+	defer conn.Close()
+	for {
+		var messages []*mDNS.Msg
+		for len(messages) < batch {
+			var rawLength [2]byte
+			_, err := io.ReadFull(conn, rawLength[:])
+			if err != nil {
+				return
+			}
+			rawMessage := make([]byte, binary.BigEndian.Uint16(rawLength[:]))
+			_, err = io.ReadFull(conn, rawMessage)
+			if err != nil {
+				return
+			}
+			message := new(mDNS.Msg)
+			if message.Unpack(rawMessage) != nil {
+				return
+			}
+			if message.Question[0].Name == "drop." {
+				continue
+			}
+			messages = append(messages, message)
+		}
+		for i := len(messages) - 1; i >= 0; i-- {
+			rawResponse, _ := handler(messages[i]).Pack()
+			_, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(rawResponse))))
+			if err != nil {
+				return
+			}
+			_, err = conn.Write(rawResponse)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestTCPTransportKeepalive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted.Add(1)
+			go serveTestStream(conn, 1, func(message *mDNS.Msg) *mDNS.Msg {
+				response := newTestAnswer(message)
+				if optRecord := message.IsEdns0(); optRecord != nil {
+					responseOPT := &mDNS.OPT{Hdr: mDNS.RR_Header{Name: ".", Rrtype: mDNS.TypeOPT}}
+					for _, option := range optRecord.Option {
+						if option.Option() == mDNS.EDNS0TCPKEEPALIVE {
+							responseOPT.Option = append(responseOPT.Option, &mDNS.EDNS0_TCP_KEEPALIVE{
+								Code:    mDNS.EDNS0TCPKEEPALIVE,
+								Timeout: 2,
+							})
+						}
+					}
+					response.Extra = append(response.Extra, responseOPT)
+				}
+				return response
+			})
+		}
+	}()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "tcp://" + listener.Addr().String(),
+		Dialer:  N.SystemDialer,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	for i := 0; i < 3; i++ {
+		response, exchangeErr := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+		require.NoError(t, exchangeErr)
+		require.Empty(t, response.Extra)
+	}
+	require.Equal(t, int32(1), accepted.Load())
+	time.Sleep(500 * time.Millisecond)
+	_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), accepted.Load())
+}
+
+type testGatedDialer struct {
+	N.Dialer
+	dials atomic.Int32
+	gate  chan struct{}
+}
+
+func (d *testGatedDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if d.dials.Add(1) > 1 {
+		<-d.gate
+	}
+	return d.Dialer.DialContext(ctx, network, destination)
+}
+
+func TestTCPTransportPendingDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go serveTestStream(conn, 1, newTestAnswer)
+		}
+	}()
+	dialer := &testGatedDialer{Dialer: N.SystemDialer, gate: make(chan struct{})}
+	defer close(dialer.gate)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "tcp://" + listener.Addr().String(),
+		Dialer:  dialer,
+		Pipeline: dns.PipelineOptions{
+			MaxConnections:          2,
+			MaxQueriesPerConnection: 1,
+			DisableKeepalive:        true,
+		},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	exchange := func(name string, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, exchangeErr := transport.Exchange(ctx, new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT))
+		return exchangeErr
+	}
+	require.NoError(t, exchange("example.com.", time.Second))
+	go exchange("drop.", time.Second)
+	time.Sleep(50 * time.Millisecond)
+	// the second connection hangs in its dial, the query waiting for it gives up
+	require.ErrorIs(t, exchange("drop.", 100*time.Millisecond), context.DeadlineExceeded)
+	// the pending dial counts toward the limit, so this query shares the first connection
+	require.NoError(t, exchange("example.com.", time.Second))
+	require.Equal(t, int32(2), dialer.dials.Load())
+}
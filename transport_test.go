@@ -2,6 +2,9 @@ package dns_test
 
 import (
 	"context"
+	"net/netip"
+	"os"
+	"sync/atomic"
 	"testing"
 
 	"github.com/sagernet/sing-dns"
@@ -9,9 +12,56 @@ import (
 	"github.com/sagernet/sing/common/logger"
 	N "github.com/sagernet/sing/common/network"
 
+	mDNS "github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
+// testTransport is a fake upstream answering through exchange, or through lookup when it is not raw.
+type testTransport struct {
+	exchange func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error)
+	lookup   func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error)
+	queries  atomic.Int32
+}
+
+func newTestTransport(exchange func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error)) *testTransport {
+	return &testTransport{exchange: exchange}
+}
+
+func (t *testTransport) Name() string {
+	return "test"
+}
+
+func (t *testTransport) Start() error {
+	return nil
+}
+
+func (t *testTransport) Reset() {
+}
+
+func (t *testTransport) Close() error {
+	return nil
+}
+
+func (t *testTransport) Raw() bool {
+	return t.lookup == nil
+}
+
+func (t *testTransport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+	t.queries.Add(1)
+	if t.exchange == nil {
+		return nil, os.ErrInvalid
+	}
+	return t.exchange(ctx, message)
+}
+
+func (t *testTransport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+	t.queries.Add(1)
+	if t.lookup == nil {
+		return nil, os.ErrInvalid
+	}
+	return t.lookup(ctx, domain, strategy)
+}
+
 func TestTransports(t *testing.T) {
 	serverAddressList := []string{
 		"114.114.114.114",
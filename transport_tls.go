@@ -3,16 +3,15 @@ package dns
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/netip"
 	"net/url"
 	"os"
-	"sync"
 
 	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/logger"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-	"github.com/sagernet/sing/common/x/list"
 
 	"github.com/miekg/dns"
 )
@@ -26,17 +25,12 @@ func init() {
 }
 
 type TLSTransport struct {
-	name        string
-	dialer      N.Dialer
-	logger      logger.ContextLogger
-	serverAddr  M.Socksaddr
-	access      sync.Mutex
-	connections list.List[*tlsDNSConn]
-}
-
-type tlsDNSConn struct {
-	*tls.Conn
-	queryId uint16
+	name       string
+	dialer     N.Dialer
+	logger     logger.ContextLogger
+	serverAddr M.Socksaddr
+	tlsConfig  *tls.Config
+	pool       *pipelinePool
 }
 
 func NewTLSTransport(options TransportOptions) (*TLSTransport, error) {
@@ -55,12 +49,15 @@ func NewTLSTransport(options TransportOptions) (*TLSTransport, error) {
 }
 
 func newTLSTransport(options TransportOptions, serverAddr M.Socksaddr) *TLSTransport {
-	return &TLSTransport{
+	transport := &TLSTransport{
 		name:       options.Name,
 		dialer:     options.Dialer,
 		logger:     options.Logger,
 		serverAddr: serverAddr,
+		tlsConfig:  NewTLSConfig(options, serverAddr.AddrString(), nil),
 	}
+	transport.pool = newPipelinePool(options.Pipeline, true, transport.dial)
+	return transport
 }
 
 func (t *TLSTransport) Name() string {
@@ -72,12 +69,7 @@ func (t *TLSTransport) Start() error {
 }
 
 func (t *TLSTransport) Reset() {
-	t.access.Lock()
-	defer t.access.Unlock()
-	for connection := t.connections.Front(); connection != nil; connection = connection.Next() {
-		connection.Value.Close()
-	}
-	t.connections.Init()
+	t.pool.Reset()
 }
 
 func (t *TLSTransport) Close() error {
@@ -90,46 +82,21 @@ func (t *TLSTransport) Raw() bool {
 }
 
 func (t *TLSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
-	t.access.Lock()
-	conn := t.connections.PopFront()
-	t.access.Unlock()
-	if conn != nil {
-		response, err := t.exchange(message, conn)
-		if err == nil {
-			return response, nil
-		}
-	}
+	return t.pool.Exchange(ctx, message)
+}
+
+func (t *TLSTransport) dial(ctx context.Context) (net.Conn, error) {
 	tcpConn, err := t.dialer.DialContext(ctx, N.NetworkTCP, t.serverAddr)
 	if err != nil {
 		return nil, err
 	}
-	tlsConn := tls.Client(tcpConn, &tls.Config{
-		ServerName: t.serverAddr.AddrString(),
-	})
+	tlsConn := tls.Client(tcpConn, t.tlsConfig)
 	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		tcpConn.Close()
 		return nil, err
 	}
-	return t.exchange(message, &tlsDNSConn{Conn: tlsConn})
-}
-
-func (t *TLSTransport) exchange(message *dns.Msg, conn *tlsDNSConn) (*dns.Msg, error) {
-	conn.queryId++
-	err := writeMessage(conn, conn.queryId, message)
-	if err != nil {
-		conn.Close()
-		return nil, E.Cause(err, "write request")
-	}
-	response, err := readMessage(conn)
-	if err != nil {
-		conn.Close()
-		return nil, E.Cause(err, "read response")
-	}
-	t.access.Lock()
-	t.connections.PushBack(conn)
-	t.access.Unlock()
-	return response, nil
+	return tlsConn, nil
 }
 
 func (t *TLSTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
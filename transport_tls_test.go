@@ -0,0 +1,214 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	rawCertificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(rawCertificate)
+	require.NoError(t, err)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{rawCertificate}, PrivateKey: privateKey, Leaf: certificate}, rootCAs
+}
+
+func newTestAnswer(message *mDNS.Msg) *mDNS.Msg {
+	response := new(mDNS.Msg)
+	response.SetReply(message)
+	response.Answer = append(response.Answer, &mDNS.TXT{
+		Hdr: mDNS.RR_Header{Name: message.Question[0].Name, Rrtype: mDNS.TypeTXT, Class: mDNS.ClassINET, Ttl: 300},
+		Txt: []string{message.Question[0].Name},
+	})
+	return response
+}
+
+func TestTLSTransportPipelining(t *testing.T) {
+	certificate, rootCAs := newTestCertificate(t)
+	const queries = 8
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	require.NoError(t, err)
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted.Add(1)
+			go serveTestStream(conn, queries, newTestAnswer)
+		}
+	}()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "tls://" + listener.Addr().String(),
+		Dialer:  N.SystemDialer,
+		TLS:     dns.TLSOptions{RootCAs: rootCAs},
+		Pipeline: dns.PipelineOptions{
+			MaxConnections: 1,
+		},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	cancelCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = transport.Exchange(cancelCtx, new(mDNS.Msg).SetQuestion("drop.", mDNS.TypeTXT))
+	cancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		name := mDNS.Fqdn(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}).String())
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			message := new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT)
+			response, exchangeErr := transport.Exchange(context.Background(), message)
+			if !assert.NoError(t, exchangeErr) {
+				return
+			}
+			assert.Equal(t, message.Id, response.Id)
+			assert.Equal(t, name, response.Answer[0].(*mDNS.TXT).Txt[0])
+		}()
+	}
+	waitGroup.Wait()
+	require.Equal(t, int32(1), accepted.Load())
+}
+
+func TestTLSTransportSessionResumption(t *testing.T) {
+	certificate, rootCAs := newTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	require.NoError(t, err)
+	defer listener.Close()
+	resumed := make(chan bool, 4)
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() != nil {
+				conn.Close()
+				continue
+			}
+			resumed <- tlsConn.ConnectionState().DidResume
+			go serveTestStream(conn, 1, newTestAnswer)
+		}
+	}()
+	newTransport := func(options dns.TLSOptions) dns.Transport {
+		options.RootCAs = rootCAs
+		transport, transportErr := dns.CreateTransport(dns.TransportOptions{
+			Context: context.Background(),
+			Logger:  logger.NOP(),
+			Address: "tls://" + listener.Addr().String(),
+			Dialer:  N.SystemDialer,
+			TLS:     options,
+		})
+		require.NoError(t, transportErr)
+		t.Cleanup(func() {
+			transport.Close()
+		})
+		return transport
+	}
+	for _, disabled := range []bool{false, true} {
+		transport := newTransport(dns.TLSOptions{DisableSessionResumption: disabled})
+		for i := 0; i < 2; i++ {
+			_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+			require.NoError(t, err)
+			transport.Reset()
+		}
+		require.False(t, <-resumed)
+		require.Equal(t, !disabled, <-resumed)
+	}
+}
+
+func TestTLSTransportPadding(t *testing.T) {
+	certificate, rootCAs := newTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	require.NoError(t, err)
+	defer listener.Close()
+	queryLengths := make(chan int, 4)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var rawLength [2]byte
+			if _, readErr := io.ReadFull(conn, rawLength[:]); readErr != nil {
+				return
+			}
+			rawMessage := make([]byte, binary.BigEndian.Uint16(rawLength[:]))
+			if _, readErr := io.ReadFull(conn, rawMessage); readErr != nil {
+				return
+			}
+			queryLengths <- len(rawMessage)
+			message := new(mDNS.Msg)
+			if message.Unpack(rawMessage) != nil {
+				return
+			}
+			rawResponse, _ := newTestAnswer(message).Pack()
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(rawResponse))), rawResponse...))
+		}
+	}()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "tls://" + listener.Addr().String(),
+		Dialer:  N.SystemDialer,
+		TLS:     dns.TLSOptions{RootCAs: rootCAs},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	for _, name := range []string{"example.com.", "a.b.c.d.e.f.g.h.example.com."} {
+		message := new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT)
+		// repeated names are compressed when written
+		message.Ns = append(message.Ns, &mDNS.NS{Hdr: mDNS.RR_Header{Name: name, Rrtype: mDNS.TypeNS, Class: mDNS.ClassINET}, Ns: name})
+		_, err = transport.Exchange(context.Background(), message)
+		require.NoError(t, err)
+		require.Zero(t, <-queryLengths%dns.PaddingBlockSize)
+	}
+}
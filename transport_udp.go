@@ -1,12 +1,18 @@
 package dns
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"net"
 	"net/netip"
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
@@ -37,9 +43,20 @@ type UDPTransport struct {
 	serverAddr   M.Socksaddr
 	clientAddr   netip.Prefix
 	udpSize      int
+	maxQueries   int
+	maxLifetime  time.Duration
 	tcpTransport *TCPTransport
 	access       sync.Mutex
 	conn         *dnsConnection
+	cookie       bool
+	strictCookie bool
+	randomCase   bool
+	// upstream quirks learned from responses, forgotten on Reset
+	noEDNS       atomic.Bool
+	caseIgnored  atomic.Bool
+	cookieAccess sync.Mutex
+	clientCookie [8]byte
+	serverCookie []byte
 }
 
 func NewUDPTransport(options TransportOptions) (*UDPTransport, error) {
@@ -56,7 +73,7 @@ func NewUDPTransport(options TransportOptions) (*UDPTransport, error) {
 		serverAddr.Port = 53
 	}
 	ctx, cancel := context.WithCancel(options.Context)
-	return &UDPTransport{
+	transport := &UDPTransport{
 		name:         options.Name,
 		optCtx:       options.Context,
 		ctx:          ctx,
@@ -66,8 +83,15 @@ func NewUDPTransport(options TransportOptions) (*UDPTransport, error) {
 		serverAddr:   serverAddr,
 		clientAddr:   options.ClientSubnet,
 		udpSize:      512,
+		maxQueries:   options.UDP.MaxQueriesPerConnection,
+		maxLifetime:  options.UDP.MaxConnectionLifetime,
 		tcpTransport: newTCPTransport(options, serverAddr),
-	}, nil
+		cookie:       !options.UDP.DisableCookie,
+		strictCookie: options.UDP.StrictCookie,
+		randomCase:   options.UDP.RandomizeCase,
+	}
+	common.Must1(rand.Read(transport.clientCookie[:]))
+	return transport, nil
 }
 
 func (t *UDPTransport) Name() string {
@@ -81,11 +105,19 @@ func (t *UDPTransport) Start() error {
 func (t *UDPTransport) Reset() {
 	t.cancel()
 	t.ctx, t.cancel = context.WithCancel(t.optCtx)
+	t.tcpTransport.Reset()
+	t.cookieAccess.Lock()
+	// RFC 7873: the client cookie changes with the client address
+	common.Must1(rand.Read(t.clientCookie[:]))
+	t.serverCookie = nil
+	t.cookieAccess.Unlock()
+	t.noEDNS.Store(false)
+	t.caseIgnored.Store(false)
 }
 
 func (t *UDPTransport) Close() error {
 	t.cancel()
-	return nil
+	return t.tcpTransport.Close()
 }
 
 func (t *UDPTransport) Raw() bool {
@@ -97,7 +129,7 @@ func (t *UDPTransport) Lookup(ctx context.Context, domain string, strategy Domai
 }
 
 func (t *UDPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
-	response, err := t.exchange(ctx, message)
+	response, err := t.exchangeCase(ctx, message)
 	if err != nil {
 		return nil, err
 	}
@@ -108,6 +140,153 @@ func (t *UDPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 	return response, nil
 }
 
+func (t *UDPTransport) exchangeCase(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if !t.randomCase || t.caseIgnored.Load() || len(message.Question) != 1 {
+		return t.exchangeCookie(ctx, message)
+	}
+	name := message.Question[0].Name
+	caseMessage := *message
+	caseMessage.Question = []dns.Question{message.Question[0]}
+	caseMessage.Question[0].Name = randomizeCase(name)
+	response, err := t.exchangeCookie(ctx, &caseMessage)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Question) != 1 || response.Question[0].Name != caseMessage.Question[0].Name {
+		// the upstream does not preserve case, spoofing it would take a second guess of the query ID
+		response, err = t.exchangeCookie(ctx, message)
+		if err == nil {
+			t.logger.DebugContext(ctx, "query name case not preserved, disabling 0x20")
+			t.caseIgnored.Store(true)
+		}
+		return response, err
+	}
+	// cache keys are questions, the random case must not leak out of the transport
+	response.Question[0].Name = name
+	for _, records := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, record := range records {
+			if record.Header().Name == caseMessage.Question[0].Name {
+				record.Header().Name = name
+			}
+		}
+	}
+	return response, nil
+}
+
+func randomizeCase(name string) string {
+	randomBytes := make([]byte, len(name))
+	common.Must1(rand.Read(randomBytes))
+	caseName := []byte(name)
+	for i, c := range caseName {
+		if randomBytes[i]&1 == 0 {
+			continue
+		}
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			caseName[i] = c ^ 0x20
+		}
+	}
+	return string(caseName)
+}
+
+func (t *UDPTransport) exchangeCookie(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if !t.cookie || t.noEDNS.Load() || findCookie(message) != nil {
+		return t.exchange(ctx, message)
+	}
+	var response *dns.Msg
+	// RFC 7873 5.3: a BADCOOKIE response carries a fresh server cookie, the query is resent once with it
+	for i := 0; i < 2; i++ {
+		clientCookie, cookieMessage := t.appendCookie(message)
+		var err error
+		response, err = t.exchange(ctx, cookieMessage)
+		if err != nil {
+			return nil, err
+		}
+		if response.Rcode == dns.RcodeFormatError && message.IsEdns0() == nil {
+			// servers without EDNS support reject the OPT record carrying the cookie
+			response, err = t.exchange(ctx, message)
+			if err == nil && response.Rcode != dns.RcodeFormatError {
+				t.logger.DebugContext(ctx, "EDNS not supported, disabling cookies")
+				t.noEDNS.Store(true)
+			}
+			return response, err
+		}
+		err = t.learnCookie(clientCookie, response)
+		if err != nil {
+			return nil, err
+		}
+		if response.Rcode != dns.RcodeBadCookie {
+			break
+		}
+	}
+	removeCookie(message, response)
+	return response, nil
+}
+
+func (t *UDPTransport) appendCookie(message *dns.Msg) ([8]byte, *dns.Msg) {
+	t.cookieAccess.Lock()
+	clientCookie := t.clientCookie
+	cookie := hex.EncodeToString(clientCookie[:]) + hex.EncodeToString(t.serverCookie)
+	t.cookieAccess.Unlock()
+	message = message.Copy()
+	optRecord := message.IsEdns0()
+	if optRecord == nil {
+		message.SetEdns0(dns.MinMsgSize, false)
+		optRecord = message.IsEdns0()
+	}
+	optRecord.Option = append(optRecord.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return clientCookie, message
+}
+
+func (t *UDPTransport) learnCookie(clientCookie [8]byte, response *dns.Msg) error {
+	cookieOption := findCookie(response)
+	if cookieOption == nil {
+		// the server does not support cookies
+		return nil
+	}
+	cookie, err := hex.DecodeString(cookieOption.Cookie)
+	if err != nil || len(cookie) < 16 || len(cookie) > 40 || !bytes.Equal(cookie[:8], clientCookie[:]) {
+		if t.strictCookie {
+			return E.New("client cookie mismatch")
+		}
+		return nil
+	}
+	t.cookieAccess.Lock()
+	if t.clientCookie == clientCookie {
+		t.serverCookie = cookie[8:]
+	}
+	t.cookieAccess.Unlock()
+	return nil
+}
+
+func findCookie(message *dns.Msg) *dns.EDNS0_COOKIE {
+	optRecord := message.IsEdns0()
+	if optRecord == nil {
+		return nil
+	}
+	for _, option := range optRecord.Option {
+		if cookieOption, isCookie := option.(*dns.EDNS0_COOKIE); isCookie {
+			return cookieOption
+		}
+	}
+	return nil
+}
+
+// removeCookie hides the cookie from the caller, along with the OPT record if only the cookie needed it.
+func removeCookie(request *dns.Msg, response *dns.Msg) {
+	optRecord := response.IsEdns0()
+	if optRecord == nil {
+		return
+	}
+	optRecord.Option = common.Filter(optRecord.Option, func(it dns.EDNS0) bool {
+		return it.Option() != dns.EDNS0COOKIE
+	})
+	if request.IsEdns0() == nil && len(optRecord.Option) == 0 && response.Rcode <= 0xF {
+		response.Extra = common.Filter(response.Extra, func(it dns.RR) bool {
+			return it.Header().Rrtype != dns.TypeOPT
+		})
+	}
+}
+
 func (t *UDPTransport) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
 	conn, err := t.open(ctx)
 	if err != nil {
@@ -127,29 +306,18 @@ func (t *UDPTransport) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 		done: make(chan struct{}),
 	}
 	conn.access.Lock()
-	conn.queryId++
-	exMessage.Id = conn.queryId
+	exMessage.Id = conn.nextQueryId()
 	conn.callbacks[exMessage.Id] = callback
+	conn.queries++
 	conn.access.Unlock()
-	defer func() {
-		conn.access.Lock()
-		delete(conn.callbacks, messageId)
-		conn.access.Unlock()
-		callback.access.Lock()
-		select {
-		case <-callback.done:
-		default:
-			close(callback.done)
-		}
-		callback.access.Unlock()
-	}()
+	defer conn.removeCallback(exMessage.Id, callback)
 	rawMessage, err := exMessage.PackBuffer(buffer.FreeBytes())
 	if err != nil {
 		return nil, err
 	}
 	_, err = conn.Write(rawMessage)
 	if err != nil {
-		conn.Close()
+		conn.closeWithError(err)
 		return nil, err
 	}
 	select {
@@ -159,21 +327,23 @@ func (t *UDPTransport) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 	case <-conn.ctx.Done():
 		return nil, E.Errors(conn.err, conn.ctx.Err())
 	case <-ctx.Done():
-		conn.Close()
 		return nil, ctx.Err()
 	}
 }
 
 func (t *UDPTransport) open(ctx context.Context) (*dnsConnection, error) {
 	connection := t.conn
-	if connection != nil && !common.Done(connection.ctx) {
+	if connection != nil && !common.Done(connection.ctx) && !t.expired(connection) {
 		return connection, nil
 	}
 	t.access.Lock()
 	defer t.access.Unlock()
 	connection = t.conn
 	if connection != nil && !common.Done(connection.ctx) {
-		return connection, nil
+		if !t.expired(connection) {
+			return connection, nil
+		}
+		connection.retire()
 	}
 	conn, err := t.dialer.DialContext(ctx, "udp", t.serverAddr)
 	if err != nil {
@@ -184,6 +354,7 @@ func (t *UDPTransport) open(ctx context.Context) (*dnsConnection, error) {
 		Conn:      conn,
 		ctx:       connCtx,
 		cancel:    cancel,
+		createdAt: time.Now(),
 		callbacks: make(map[uint16]*dnsCallback),
 	}
 	t.conn = connection
@@ -191,6 +362,19 @@ func (t *UDPTransport) open(ctx context.Context) (*dnsConnection, error) {
 	return connection, nil
 }
 
+// expired reports whether the connection has to be replaced to rotate the source port.
+func (t *UDPTransport) expired(conn *dnsConnection) bool {
+	if t.maxQueries > 0 {
+		conn.access.RLock()
+		queries := conn.queries
+		conn.access.RUnlock()
+		if queries >= t.maxQueries {
+			return true
+		}
+	}
+	return t.maxLifetime > 0 && time.Since(conn.createdAt) >= t.maxLifetime
+}
+
 func (t *UDPTransport) recvLoop(conn *dnsConnection) {
 	var group task.Group
 	group.Append0(func(ctx context.Context) error {
@@ -199,28 +383,26 @@ func (t *UDPTransport) recvLoop(conn *dnsConnection) {
 			_, err := buffer.ReadOnceFrom(conn)
 			if err != nil {
 				buffer.Release()
+				conn.closeWithError(err)
 				return err
 			}
 			var message dns.Msg
 			err = message.Unpack(buffer.Bytes())
 			buffer.Release()
 			if err != nil {
-				return err
+				continue
 			}
-			conn.access.RLock()
+			conn.access.Lock()
 			callback, loaded := conn.callbacks[message.Id]
-			conn.access.RUnlock()
+			if loaded {
+				delete(conn.callbacks, message.Id)
+			}
+			conn.access.Unlock()
 			if !loaded {
 				continue
 			}
-			callback.access.Lock()
-			select {
-			case <-callback.done:
-			default:
-				callback.message = &message
-				close(callback.done)
-			}
-			callback.access.Unlock()
+			callback.message = &message
+			close(callback.done)
 		}
 	})
 	group.Cleanup(func() {
@@ -233,19 +415,63 @@ type dnsConnection struct {
 	net.Conn
 	ctx       context.Context
 	cancel    context.CancelFunc
+	createdAt time.Time
 	access    sync.RWMutex
 	err       error
-	queryId   uint16
+	queries   int
+	retired   bool
 	callbacks map[uint16]*dnsCallback
 }
 
+// nextQueryId draws a random query ID that is not in flight, must be called with access held.
+func (c *dnsConnection) nextQueryId() uint16 {
+	var queryId [2]byte
+	for {
+		common.Must1(rand.Read(queryId[:]))
+		if _, loaded := c.callbacks[binary.BigEndian.Uint16(queryId[:])]; !loaded {
+			return binary.BigEndian.Uint16(queryId[:])
+		}
+	}
+}
+
+func (c *dnsConnection) removeCallback(queryId uint16, callback *dnsCallback) {
+	c.access.Lock()
+	if c.callbacks[queryId] == callback {
+		delete(c.callbacks, queryId)
+	}
+	closeNow := c.retired && len(c.callbacks) == 0
+	c.access.Unlock()
+	if closeNow {
+		c.Close()
+	}
+}
+
+// retire closes the connection once all in-flight queries are answered or cancelled.
+func (c *dnsConnection) retire() {
+	c.access.Lock()
+	c.retired = true
+	closeNow := len(c.callbacks) == 0
+	c.access.Unlock()
+	if closeNow {
+		c.Close()
+	}
+}
+
+func (c *dnsConnection) closeWithError(err error) {
+	c.access.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.access.Unlock()
+	c.Close()
+}
+
 func (c *dnsConnection) Close() error {
 	c.cancel()
 	return c.Conn.Close()
 }
 
 type dnsCallback struct {
-	access  sync.Mutex
 	message *dns.Msg
 	done    chan struct{}
 }
@@ -0,0 +1,243 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newUDPTestServer(t *testing.T, handler func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, source, readErr := conn.ReadFrom(buffer)
+			if readErr != nil {
+				return
+			}
+			message := new(mDNS.Msg)
+			if message.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := handler(source.(*net.UDPAddr), message)
+			if response == nil {
+				continue
+			}
+			rawResponse, _ := response.Pack()
+			conn.WriteTo(rawResponse, source)
+		}
+	}()
+	return conn
+}
+
+func TestUDPTransportRotation(t *testing.T) {
+	sourcePorts := make(chan int, 16)
+	server := newUDPTestServer(t, func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg {
+		if message.Question[0].Name == "drop." {
+			return nil
+		}
+		sourcePorts <- source.Port
+		return newTestAnswer(message)
+	})
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: server.LocalAddr().String(),
+		Dialer:  N.SystemDialer,
+		UDP: dns.UDPOptions{
+			MaxQueriesPerConnection: 3,
+		},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = transport.Exchange(ctx, new(mDNS.Msg).SetQuestion("drop.", mDNS.TypeTXT))
+	cancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	for i := 0; i < 4; i++ {
+		message := new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT)
+		response, exchangeErr := transport.Exchange(context.Background(), message)
+		require.NoError(t, exchangeErr)
+		require.Equal(t, message.Id, response.Id)
+	}
+	firstPort := <-sourcePorts
+	require.Equal(t, firstPort, <-sourcePorts)
+	secondPort := <-sourcePorts
+	require.NotEqual(t, firstPort, secondPort)
+	require.Equal(t, secondPort, <-sourcePorts)
+}
+
+func TestUDPTransportCookie(t *testing.T) {
+	const serverCookie = "5e4ef0c0ffee0001"
+	cookies := make(chan string, 8)
+	newServer := func(echoCookie func(clientCookie string) string) net.PacketConn {
+		return newUDPTestServer(t, func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg {
+			var cookie string
+			if optRecord := message.IsEdns0(); optRecord != nil {
+				for _, option := range optRecord.Option {
+					if cookieOption, isCookie := option.(*mDNS.EDNS0_COOKIE); isCookie {
+						cookie = cookieOption.Cookie
+					}
+				}
+			}
+			cookies <- cookie
+			response := newTestAnswer(message)
+			if len(cookie) < 16 {
+				return response
+			}
+			if cookie[16:] != serverCookie {
+				response.Answer = nil
+				response.Rcode = mDNS.RcodeBadCookie
+			}
+			response.SetEdns0(mDNS.MinMsgSize, false)
+			optRecord := response.IsEdns0()
+			optRecord.Option = append(optRecord.Option, &mDNS.EDNS0_COOKIE{Code: mDNS.EDNS0COOKIE, Cookie: echoCookie(cookie[:16]) + serverCookie})
+			return response
+		})
+	}
+	newTransport := func(server net.PacketConn, options dns.UDPOptions) dns.Transport {
+		transport, err := dns.CreateTransport(dns.TransportOptions{
+			Context: context.Background(),
+			Logger:  logger.NOP(),
+			Address: server.LocalAddr().String(),
+			Dialer:  N.SystemDialer,
+			UDP:     options,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			transport.Close()
+		})
+		return transport
+	}
+	exchange := func(transport dns.Transport) (*mDNS.Msg, error) {
+		return transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+	}
+
+	transport := newTransport(newServer(func(clientCookie string) string {
+		return clientCookie
+	}), dns.UDPOptions{StrictCookie: true})
+	response, err := exchange(transport)
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Nil(t, response.IsEdns0())
+	clientCookie := <-cookies
+	require.Len(t, clientCookie, 16)
+	require.Equal(t, clientCookie+serverCookie, <-cookies)
+	_, err = exchange(transport)
+	require.NoError(t, err)
+	require.Equal(t, clientCookie+serverCookie, <-cookies)
+
+	spoofed := newServer(func(clientCookie string) string {
+		return "0000000000000000"
+	})
+	_, err = exchange(newTransport(spoofed, dns.UDPOptions{StrictCookie: true}))
+	require.ErrorContains(t, err, "client cookie mismatch")
+	<-cookies
+	_, err = exchange(newTransport(spoofed, dns.UDPOptions{DisableCookie: true}))
+	require.NoError(t, err)
+	require.Empty(t, <-cookies)
+}
+
+func TestUDPTransportRandomizeCase(t *testing.T) {
+	names := make(chan string, 8)
+	newTransport := func(preserveCase bool) dns.Transport {
+		server := newUDPTestServer(t, func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg {
+			names <- message.Question[0].Name
+			if !preserveCase {
+				message.Question[0].Name = strings.ToLower(message.Question[0].Name)
+			}
+			return newTestAnswer(message)
+		})
+		transport, err := dns.CreateTransport(dns.TransportOptions{
+			Context: context.Background(),
+			Logger:  logger.NOP(),
+			Address: server.LocalAddr().String(),
+			Dialer:  N.SystemDialer,
+			UDP: dns.UDPOptions{
+				DisableCookie: true,
+				RandomizeCase: true,
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			transport.Close()
+		})
+		return transport
+	}
+	const name = "example.com."
+	var randomized bool
+	transport := newTransport(true)
+	for i := 0; i < 4; i++ {
+		response, err := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT))
+		require.NoError(t, err)
+		require.Equal(t, name, response.Question[0].Name)
+		require.Equal(t, name, response.Answer[0].Header().Name)
+		sentName := <-names
+		require.True(t, strings.EqualFold(name, sentName))
+		randomized = randomized || sentName != name
+	}
+	require.True(t, randomized)
+
+	transport = newTransport(false)
+	response, err := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT))
+	require.NoError(t, err)
+	require.Equal(t, name, response.Question[0].Name)
+	sentName := <-names
+	if sentName != name {
+		require.Equal(t, name, <-names)
+	}
+	// the upstream is remembered to ignore case, until the transport is reset
+	for i := 0; i < 2; i++ {
+		_, err = transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion(name, mDNS.TypeTXT))
+		require.NoError(t, err)
+		require.Equal(t, name, <-names)
+		require.Empty(t, names)
+	}
+}
+
+func TestUDPTransportCookieNoEDNS(t *testing.T) {
+	var queries atomic.Int32
+	server := newUDPTestServer(t, func(source *net.UDPAddr, message *mDNS.Msg) *mDNS.Msg {
+		queries.Add(1)
+		if message.IsEdns0() != nil {
+			response := new(mDNS.Msg)
+			response.SetRcode(message, mDNS.RcodeFormatError)
+			return response
+		}
+		return newTestAnswer(message)
+	})
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: server.LocalAddr().String(),
+		Dialer:  N.SystemDialer,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	exchange := func() {
+		response, exchangeErr := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion("example.com.", mDNS.TypeTXT))
+		require.NoError(t, exchangeErr)
+		require.Len(t, response.Answer, 1)
+	}
+	exchange()
+	require.Equal(t, int32(2), queries.Load())
+	exchange()
+	require.Equal(t, int32(3), queries.Load())
+	transport.Reset()
+	exchange()
+	require.Equal(t, int32(5), queries.Load())
+}
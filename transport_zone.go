@@ -0,0 +1,326 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/miekg/dns"
+)
+
+const zoneMaxCNAMEChain = 8
+
+// ZoneOptions configures the zone transport. Records are added after the zone file, and
+// Origin is only needed when neither contains an SOA record.
+type ZoneOptions struct {
+	Path    string
+	Origin  string
+	Records []dns.RR
+}
+
+var _ Transport = (*ZoneTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"zone"}, func(options TransportOptions) (Transport, error) {
+		return NewZoneTransport(options)
+	})
+}
+
+// ZoneTransport answers authoritatively from a single zone, names outside it are refused.
+type ZoneTransport struct {
+	name    string
+	origin  string
+	access  sync.RWMutex
+	records map[string][]dns.RR
+}
+
+func NewZoneTransport(options TransportOptions) (*ZoneTransport, error) {
+	zoneOptions := options.Zone
+	if options.Address != "zone" {
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		if serverURL.Path != "" {
+			zoneOptions.Path = serverURL.Path
+		}
+	}
+	var records []dns.RR
+	if zoneOptions.Path != "" {
+		file, err := os.Open(zoneOptions.Path)
+		if err != nil {
+			return nil, err
+		}
+		origin := zoneOptions.Origin
+		if origin != "" {
+			origin = dns.Fqdn(origin)
+		}
+		parser := dns.NewZoneParser(file, origin, zoneOptions.Path)
+		for record, ok := parser.Next(); ok; record, ok = parser.Next() {
+			records = append(records, record)
+		}
+		file.Close()
+		if err = parser.Err(); err != nil {
+			return nil, E.Cause(err, "parse zone file")
+		}
+	}
+	records = append(records, zoneOptions.Records...)
+	transport := &ZoneTransport{
+		name:    options.Name,
+		records: make(map[string][]dns.RR),
+	}
+	for _, record := range records {
+		if record.Header().Rrtype == dns.TypeSOA {
+			transport.origin = dns.CanonicalName(record.Header().Name)
+			break
+		}
+	}
+	if transport.origin == "" {
+		if zoneOptions.Origin == "" {
+			return nil, E.New("missing zone origin")
+		}
+		transport.origin = dns.CanonicalName(zoneOptions.Origin)
+		records = append(records, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: transport.origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      transport.origin,
+			Mbox:    "hostmaster." + transport.origin,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		})
+	}
+	for _, record := range records {
+		err := transport.AddRecord(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return transport, nil
+}
+
+func (t *ZoneTransport) Name() string {
+	return t.name
+}
+
+func (t *ZoneTransport) Start() error {
+	return nil
+}
+
+func (t *ZoneTransport) Reset() {
+}
+
+func (t *ZoneTransport) Close() error {
+	return nil
+}
+
+func (t *ZoneTransport) Raw() bool {
+	return true
+}
+
+// AddRecord adds a record to the zone, an identical record is only kept once.
+func (t *ZoneTransport) AddRecord(record dns.RR) error {
+	name := dns.CanonicalName(record.Header().Name)
+	if !dns.IsSubDomain(t.origin, name) {
+		return E.New("record ", record.Header().Name, " is outside of zone ", t.origin)
+	}
+	record = dns.Copy(record)
+	record.Header().Name = name
+	t.access.Lock()
+	defer t.access.Unlock()
+	for _, existing := range t.records[name] {
+		if dns.IsDuplicate(existing, record) {
+			return nil
+		}
+	}
+	t.records[name] = append(t.records[name], record)
+	return nil
+}
+
+// RemoveRecord removes the records identical to record, TTLs are ignored.
+func (t *ZoneTransport) RemoveRecord(record dns.RR) {
+	name := dns.CanonicalName(record.Header().Name)
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.removeRecords(name, func(existing dns.RR) bool {
+		return dns.IsDuplicate(existing, record)
+	})
+}
+
+// RemoveRecords removes all records of rrType at name, dns.TypeANY removes the whole name.
+func (t *ZoneTransport) RemoveRecords(name string, rrType uint16) {
+	name = dns.CanonicalName(name)
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.removeRecords(name, func(existing dns.RR) bool {
+		return rrType == dns.TypeANY || existing.Header().Rrtype == rrType
+	})
+}
+
+func (t *ZoneTransport) removeRecords(name string, match func(existing dns.RR) bool) {
+	records := t.records[name][:0]
+	for _, existing := range t.records[name] {
+		if !match(existing) || existing.Header().Rrtype == dns.TypeSOA && name == t.origin {
+			records = append(records, existing)
+		}
+	}
+	if len(records) == 0 {
+		delete(t.records, name)
+	} else {
+		t.records[name] = records
+	}
+}
+
+func (t *ZoneTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 0 {
+		return nil, E.New("bad question size: ", len(message.Question))
+	}
+	question := message.Question[0]
+	response := new(dns.Msg)
+	response.SetReply(message)
+	qName := dns.CanonicalName(question.Name)
+	if !dns.IsSubDomain(t.origin, qName) {
+		response.Rcode = dns.RcodeRefused
+		return response, nil
+	}
+	t.access.RLock()
+	defer t.access.RUnlock()
+	response.Authoritative = true
+	for chain := 0; ; chain++ {
+		if delegation := t.delegation(qName); delegation != nil {
+			// referrals are not authoritative, unless part of the answer came from a CNAME
+			response.Authoritative = len(response.Answer) > 0
+			response.Ns = copyRecords(delegation, "")
+			for _, record := range delegation {
+				target := dns.CanonicalName(record.(*dns.NS).Ns)
+				for _, glue := range t.records[target] {
+					if glue.Header().Rrtype == dns.TypeA || glue.Header().Rrtype == dns.TypeAAAA {
+						response.Extra = append(response.Extra, dns.Copy(glue))
+					}
+				}
+			}
+			return response, nil
+		}
+		records, loaded := t.records[qName]
+		ownerName := ""
+		if !loaded {
+			if t.hasDescendant(qName) {
+				// empty non-terminal
+				response.Ns = t.negativeAuthority()
+				return response, nil
+			}
+			records, loaded = t.records[t.wildcard(qName)]
+			ownerName = qName
+		}
+		if !loaded {
+			// RFC 6604: the rcode describes the last name of a CNAME chain
+			response.Rcode = dns.RcodeNameError
+			response.Ns = t.negativeAuthority()
+			return response, nil
+		}
+		var (
+			answered bool
+			cname    dns.RR
+		)
+		for _, record := range records {
+			recordType := record.Header().Rrtype
+			if recordType == question.Qtype || question.Qtype == dns.TypeANY {
+				response.Answer = append(response.Answer, copyRecords([]dns.RR{record}, ownerName)...)
+				answered = true
+			} else if recordType == dns.TypeCNAME {
+				cname = record
+			}
+		}
+		if answered || cname == nil {
+			if !answered {
+				response.Ns = t.negativeAuthority()
+			}
+			return response, nil
+		}
+		response.Answer = append(response.Answer, copyRecords([]dns.RR{cname}, ownerName)...)
+		qName = dns.CanonicalName(cname.(*dns.CNAME).Target)
+		if !dns.IsSubDomain(t.origin, qName) || chain >= zoneMaxCNAMEChain {
+			return response, nil
+		}
+	}
+}
+
+func (t *ZoneTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+// delegation returns the NS records of the zone cut at or above name, below the origin.
+func (t *ZoneTransport) delegation(name string) []dns.RR {
+	labels := dns.SplitDomainName(name)
+	originLabels := dns.CountLabel(t.origin)
+	for index := 0; index < len(labels)-originLabels; index++ {
+		nsRecords := t.recordsOf(dns.Fqdn(strings.Join(labels[index:], ".")), dns.TypeNS)
+		if len(nsRecords) > 0 {
+			return nsRecords
+		}
+	}
+	return nil
+}
+
+// hasDescendant reports whether name is an empty non-terminal, which blocks wildcard matching.
+func (t *ZoneTransport) hasDescendant(name string) bool {
+	for recordName := range t.records {
+		if recordName != name && dns.IsSubDomain(name, recordName) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcard returns the wildcard name at the closest encloser of name.
+func (t *ZoneTransport) wildcard(name string) string {
+	for {
+		offset, end := dns.NextLabel(name, 0)
+		if end {
+			return "*."
+		}
+		name = name[offset:]
+		if _, loaded := t.records[name]; loaded || name == t.origin || t.hasDescendant(name) {
+			return "*." + name
+		}
+	}
+}
+
+func (t *ZoneTransport) recordsOf(name string, rrType uint16) []dns.RR {
+	var records []dns.RR
+	for _, record := range t.records[name] {
+		if record.Header().Rrtype == rrType {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// negativeAuthority returns the SOA for negative answers, with the TTL capped by its minimum as in RFC 2308.
+func (t *ZoneTransport) negativeAuthority() []dns.RR {
+	records := copyRecords(t.recordsOf(t.origin, dns.TypeSOA), "")
+	for _, record := range records {
+		if soa := record.(*dns.SOA); soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+	}
+	return records
+}
+
+func copyRecords(records []dns.RR, ownerName string) []dns.RR {
+	copied := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		record = dns.Copy(record)
+		if ownerName != "" {
+			record.Header().Name = ownerName
+		}
+		copied = append(copied, record)
+	}
+	return copied
+}
@@ -0,0 +1,96 @@
+package dns_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 300
+@         IN SOA  ns.example.com. hostmaster.example.com. 1 3600 600 86400 60
+@         IN NS   ns
+ns        IN A    192.0.2.53
+www       IN A    192.0.2.1
+alias     IN CNAME www
+external  IN CNAME www.example.org.
+*.apps    IN A    192.0.2.2
+a.b       IN TXT  "empty non-terminal above"
+sub       IN NS   ns.sub
+ns.sub    IN A    192.0.2.54
+`
+
+func TestZoneTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZone), 0o644))
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Address: "zone://" + path,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	exchange := func(name string, qType uint16) *mDNS.Msg {
+		response, exchangeErr := transport.Exchange(context.Background(), new(mDNS.Msg).SetQuestion(name, qType))
+		require.NoError(t, exchangeErr)
+		return response
+	}
+	requireNegative := func(response *mDNS.Msg, rcode int) {
+		require.Equal(t, rcode, response.Rcode)
+		require.True(t, response.Authoritative)
+		require.Empty(t, response.Answer)
+		require.Len(t, response.Ns, 1)
+		require.Equal(t, uint32(60), response.Ns[0].(*mDNS.SOA).Hdr.Ttl)
+	}
+
+	response := exchange("WWW.example.com.", mDNS.TypeA)
+	require.True(t, response.Authoritative)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "192.0.2.1", response.Answer[0].(*mDNS.A).A.String())
+	requireNegative(exchange("www.example.com.", mDNS.TypeAAAA), mDNS.RcodeSuccess)
+	requireNegative(exchange("missing.example.com.", mDNS.TypeA), mDNS.RcodeNameError)
+	requireNegative(exchange("b.example.com.", mDNS.TypeA), mDNS.RcodeSuccess)
+
+	response = exchange("alias.example.com.", mDNS.TypeA)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "www.example.com.", response.Answer[0].(*mDNS.CNAME).Target)
+	response = exchange("external.example.com.", mDNS.TypeA)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+
+	response = exchange("web.apps.example.com.", mDNS.TypeA)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "web.apps.example.com.", response.Answer[0].Header().Name)
+
+	response = exchange("host.sub.example.com.", mDNS.TypeA)
+	require.False(t, response.Authoritative)
+	require.Empty(t, response.Answer)
+	require.Len(t, response.Ns, 1)
+	require.Len(t, response.Extra, 1)
+
+	response = exchange("example.org.", mDNS.TypeA)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+
+	zoneTransport := transport.(*dns.ZoneTransport)
+	record, err := mDNS.NewRR("service.example.com. 60 IN A 192.0.2.10")
+	require.NoError(t, err)
+	require.NoError(t, zoneTransport.AddRecord(record))
+	response = exchange("service.example.com.", mDNS.TypeA)
+	require.Len(t, response.Answer, 1)
+	zoneTransport.RemoveRecord(record)
+	requireNegative(exchange("service.example.com.", mDNS.TypeA), mDNS.RcodeNameError)
+	zoneTransport.RemoveRecords("www.example.com.", mDNS.TypeANY)
+	response = exchange("alias.example.com.", mDNS.TypeA)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	outsideRecord, err := mDNS.NewRR("www.example.org. 60 IN A 192.0.2.11")
+	require.NoError(t, err)
+	require.Error(t, zoneTransport.AddRecord(outsideRecord))
+}
@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"net/url"
+	"strings"
+)
+
+func isURITemplate(destination string) bool {
+	return strings.Contains(destination, "{")
+}
+
+// expandURITemplate expands an RFC 6570 template in which dns is the only defined variable.
+// An empty value leaves the variable undefined, loaded reports whether dns was expanded.
+func expandURITemplate(template string, value string) (expanded string, loaded bool) {
+	var builder strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			builder.WriteString(template)
+			break
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			builder.WriteString(template)
+			break
+		}
+		builder.WriteString(template[:start])
+		expression := template[start+1 : start+end]
+		template = template[start+end+1:]
+		var operator byte
+		if expression != "" && strings.IndexByte("+#./;?&", expression[0]) >= 0 {
+			operator = expression[0]
+			expression = expression[1:]
+		}
+		if value == "" {
+			continue
+		}
+		for _, variable := range strings.Split(expression, ",") {
+			variable = strings.TrimSuffix(variable, "*")
+			if index := strings.IndexByte(variable, ':'); index >= 0 {
+				variable = variable[:index]
+			}
+			if variable != "dns" {
+				continue
+			}
+			switch operator {
+			case 0, '+':
+			case '?', '&', ';':
+				builder.WriteByte(operator)
+				builder.WriteString("dns=")
+			default:
+				builder.WriteByte(operator)
+			}
+			builder.WriteString(url.QueryEscape(value))
+			loaded = true
+			break
+		}
+	}
+	return builder.String(), loaded
+}